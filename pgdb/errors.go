@@ -0,0 +1,34 @@
+package pgdb
+
+import "errors"
+
+var (
+	// ErrNotFound is returned (wrapped) by Get methods when no row matches the query.
+	ErrNotFound = errors.New("not found")
+
+	// ErrRankOutOfRange is returned when a role rank falls outside [0, count] for its organization.
+	ErrRankOutOfRange = errors.New("rank out of range")
+
+	// ErrInvalidRolesRanks is returned by UpdateRolesRanks and InsertDefaults when the requested
+	// order is not a valid assignment of ranks to the organization's roles.
+	ErrInvalidRolesRanks = errors.New("invalid roles ranks")
+
+	// ErrOrganizationHasRoles is returned by InsertDefaults when the organization already has roles.
+	ErrOrganizationHasRoles = errors.New("organization already has roles")
+)
+
+// QueryError is returned by the Q methods when building, executing or scanning a query fails.
+// Op describes the failed step (e.g. "executing select query") and Table is the table it was run against.
+type QueryError struct {
+	Table string
+	Op    string
+	Err   error
+}
+
+func (e *QueryError) Error() string {
+	return e.Op + " for " + e.Table + ": " + e.Err.Error()
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
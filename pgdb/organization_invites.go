@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
@@ -15,6 +14,15 @@ import (
 const OrganizationInviteTable = "organization_invites"
 const OrganizationInviteColumns = "id, organization_id, account_id, status, expires_at, created_at"
 
+// Invite statuses as stored in organization_invite_status.
+// A pending invite, still awaiting an answer, is stored as 'sent'.
+const (
+	InviteStatusPending  = "sent"
+	InviteStatusAccepted = "accepted"
+	InviteStatusDeclined = "declined"
+	InviteStatusExpired  = "expired"
+)
+
 type OrganizationInvite struct {
 	ID             uuid.UUID `json:"id"`
 	OrganizationID uuid.UUID `json:"organization_id"`
@@ -33,7 +41,7 @@ func (i *OrganizationInvite) scan(row sq.RowScanner) error {
 		&i.ExpiresAt,
 		&i.CreatedAt,
 	); err != nil {
-		return fmt.Errorf("scanning invite: %w", err)
+		return &QueryError{Table: OrganizationInviteTable, Op: "scanning row", Err: err}
 	}
 	return nil
 }
@@ -72,7 +80,42 @@ func (q OrgInvitesQ) Insert(ctx context.Context, data InsertInviteParams) (Organ
 		"expires_at":      data.ExpiresAt,
 	}).Suffix("RETURNING " + OrganizationInviteColumns).ToSql()
 	if err != nil {
-		return OrganizationInvite{}, fmt.Errorf("building insert query for %s: %w", OrganizationInviteTable, err)
+		return OrganizationInvite{}, &QueryError{Table: OrganizationInviteTable, Op: "building insert query", Err: err}
+	}
+
+	var out OrganizationInvite
+	if err = out.scan(q.db.QueryRowContext(ctx, query, args...)); err != nil {
+		return OrganizationInvite{}, err
+	}
+	return out, nil
+}
+
+type UpsertInviteParams struct {
+	ID             uuid.UUID
+	OrganizationID uuid.UUID
+	AccountID      uuid.UUID
+	Status         string
+	ExpiresAt      time.Time
+}
+
+func (q OrgInvitesQ) Upsert(ctx context.Context, data UpsertInviteParams) (OrganizationInvite, error) {
+	query, args, err := q.inserter.
+		SetMap(map[string]any{
+			"id":              data.ID,
+			"organization_id": data.OrganizationID,
+			"account_id":      data.AccountID,
+			"status":          data.Status,
+			"expires_at":      data.ExpiresAt,
+		}).
+		Suffix(`
+			ON CONFLICT (id) DO UPDATE SET
+				status     = EXCLUDED.status,
+				expires_at = EXCLUDED.expires_at
+			RETURNING ` + OrganizationInviteColumns,
+		).
+		ToSql()
+	if err != nil {
+		return OrganizationInvite{}, &QueryError{Table: OrganizationInviteTable, Op: "building upsert query", Err: err}
 	}
 
 	var out OrganizationInvite
@@ -85,14 +128,14 @@ func (q OrgInvitesQ) Insert(ctx context.Context, data InsertInviteParams) (Organ
 func (q OrgInvitesQ) Get(ctx context.Context) (OrganizationInvite, error) {
 	query, args, err := q.selector.Limit(1).ToSql()
 	if err != nil {
-		return OrganizationInvite{}, fmt.Errorf("building select query for %s: %w", OrganizationInviteTable, err)
+		return OrganizationInvite{}, &QueryError{Table: OrganizationInviteTable, Op: "building select query", Err: err}
 	}
 
 	var out OrganizationInvite
 	if err = out.scan(q.db.QueryRowContext(ctx, query, args...)); err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return OrganizationInvite{}, nil
+			return OrganizationInvite{}, &QueryError{Table: OrganizationInviteTable, Op: "getting row", Err: ErrNotFound}
 		default:
 			return OrganizationInvite{}, err
 		}
@@ -100,49 +143,106 @@ func (q OrgInvitesQ) Get(ctx context.Context) (OrganizationInvite, error) {
 	return out, nil
 }
 
+func (q OrgInvitesQ) GetByID(ctx context.Context, id uuid.UUID) (OrganizationInvite, error) {
+	return q.FilterByID(id).Get(ctx)
+}
+
 func (q OrgInvitesQ) Select(ctx context.Context) ([]OrganizationInvite, error) {
 	query, args, err := q.selector.ToSql()
 	if err != nil {
-		return nil, fmt.Errorf("building select query for %s: %w", OrganizationInviteTable, err)
+		return nil, &QueryError{Table: OrganizationInviteTable, Op: "building select query", Err: err}
 	}
 
 	rows, err := q.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("executing select query for %s: %w", OrganizationInviteTable, err)
+		return nil, &QueryError{Table: OrganizationInviteTable, Op: "executing select query", Err: err}
 	}
 	defer rows.Close()
 
 	var out []OrganizationInvite
-	for rows.Next() {
-		var i OrganizationInvite
-		if err = i.scan(rows); err != nil {
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		var inv OrganizationInvite
+		if err = inv.scan(rows); err != nil {
 			return nil, err
 		}
-		out = append(out, i)
+		out = append(out, inv)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, &QueryError{Table: OrganizationInviteTable, Op: "iterating rows", Err: err}
 	}
 
 	return out, nil
 }
 
+func (q OrgInvitesQ) Each(ctx context.Context, fn func(OrganizationInvite) error) error {
+	query, args, err := q.selector.ToSql()
+	if err != nil {
+		return &QueryError{Table: OrganizationInviteTable, Op: "building select query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &QueryError{Table: OrganizationInviteTable, Op: "executing select query", Err: err}
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		var inv OrganizationInvite
+		if err = inv.scan(rows); err != nil {
+			return err
+		}
+		if err = fn(inv); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return &QueryError{Table: OrganizationInviteTable, Op: "iterating rows", Err: err}
+	}
+
+	return nil
+}
+
 func (q OrgInvitesQ) Delete(ctx context.Context) error {
+	_, err := q.DeleteReturning(ctx)
+	return err
+}
+
+func (q OrgInvitesQ) DeleteReturning(ctx context.Context) (int64, error) {
 	query, args, err := q.deleter.ToSql()
 	if err != nil {
-		return fmt.Errorf("building delete query for %s: %w", OrganizationInviteTable, err)
+		return 0, &QueryError{Table: OrganizationInviteTable, Op: "building delete query", Err: err}
 	}
 
-	if _, err = q.db.ExecContext(ctx, query, args...); err != nil {
-		return fmt.Errorf("executing delete query for %s: %w", OrganizationInviteTable, err)
+	res, err := q.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationInviteTable, Op: "executing delete query", Err: err}
 	}
-	return nil
+
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationInviteTable, Op: "rows affected", Err: err}
+	}
+
+	return aff, nil
 }
 
 func (q OrgInvitesQ) UpdateOne(ctx context.Context) (OrganizationInvite, error) {
 	query, args, err := q.updater.Suffix("RETURNING " + OrganizationInviteColumns).ToSql()
 	if err != nil {
-		return OrganizationInvite{}, fmt.Errorf("building update query for %s: %w", OrganizationInviteTable, err)
+		return OrganizationInvite{}, &QueryError{Table: OrganizationInviteTable, Op: "building update query", Err: err}
 	}
 
 	var out OrganizationInvite
@@ -155,22 +255,30 @@ func (q OrgInvitesQ) UpdateOne(ctx context.Context) (OrganizationInvite, error)
 func (q OrgInvitesQ) UpdateMany(ctx context.Context) (int64, error) {
 	query, args, err := q.updater.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building update query for %s: %w", OrganizationInviteTable, err)
+		return 0, &QueryError{Table: OrganizationInviteTable, Op: "building update query", Err: err}
 	}
 
 	res, err := q.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return 0, fmt.Errorf("executing update query for %s: %w", OrganizationInviteTable, err)
+		return 0, &QueryError{Table: OrganizationInviteTable, Op: "executing update query", Err: err}
 	}
 
 	aff, err := res.RowsAffected()
 	if err != nil {
-		return 0, fmt.Errorf("rows affected for %s: %w", OrganizationInviteTable, err)
+		return 0, &QueryError{Table: OrganizationInviteTable, Op: "rows affected", Err: err}
 	}
 
 	return aff, nil
 }
 
+// ExpirePending marks every invite still awaiting an answer whose expires_at is before now as expired.
+func (q OrgInvitesQ) ExpirePending(ctx context.Context, now time.Time) (int64, error) {
+	return q.
+		FilterExpired(now).
+		UpdateStatus(InviteStatusExpired).
+		UpdateMany(ctx)
+}
+
 func (q OrgInvitesQ) FilterByID(id uuid.UUID) OrgInvitesQ {
 	q.selector = q.selector.Where(sq.Eq{"id": id})
 	q.counter = q.counter.Where(sq.Eq{"id": id})
@@ -203,6 +311,10 @@ func (q OrgInvitesQ) FilterByStatus(status string) OrgInvitesQ {
 	return q
 }
 
+func (q OrgInvitesQ) FilterPending() OrgInvitesQ {
+	return q.FilterByStatus(InviteStatusPending)
+}
+
 func (q OrgInvitesQ) FilterExpiresBefore(t time.Time) OrgInvitesQ {
 	q.selector = q.selector.Where(sq.Lt{"expires_at": t})
 	q.counter = q.counter.Where(sq.Lt{"expires_at": t})
@@ -211,6 +323,11 @@ func (q OrgInvitesQ) FilterExpiresBefore(t time.Time) OrgInvitesQ {
 	return q
 }
 
+// FilterExpired matches invites that are still pending but whose expires_at has passed.
+func (q OrgInvitesQ) FilterExpired(now time.Time) OrgInvitesQ {
+	return q.FilterPending().FilterExpiresBefore(now)
+}
+
 func (q OrgInvitesQ) FilterExpiresAfter(t time.Time) OrgInvitesQ {
 	q.selector = q.selector.Where(sq.GtOrEq{"expires_at": t})
 	q.counter = q.counter.Where(sq.GtOrEq{"expires_at": t})
@@ -219,6 +336,16 @@ func (q OrgInvitesQ) FilterExpiresAfter(t time.Time) OrgInvitesQ {
 	return q
 }
 
+func (q OrgInvitesQ) FilterCreatedBetween(from, to time.Time) OrgInvitesQ {
+	expr := sq.And{sq.GtOrEq{"created_at": from}, sq.Lt{"created_at": to}}
+
+	q.selector = q.selector.Where(expr)
+	q.counter = q.counter.Where(expr)
+	q.updater = q.updater.Where(expr)
+	q.deleter = q.deleter.Where(expr)
+	return q
+}
+
 func (q OrgInvitesQ) UpdateStatus(status string) OrgInvitesQ {
 	q.updater = q.updater.Set("status", status)
 	return q
@@ -232,16 +359,48 @@ func (q OrgInvitesQ) UpdateExpiresAt(t time.Time) OrgInvitesQ {
 func (q OrgInvitesQ) Count(ctx context.Context) (uint, error) {
 	query, args, err := q.counter.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building count query for %s: %w", OrganizationInviteTable, err)
+		return 0, &QueryError{Table: OrganizationInviteTable, Op: "building count query", Err: err}
 	}
 
 	var n uint
 	if err = q.db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
-		return 0, fmt.Errorf("scanning count for %s: %w", OrganizationInviteTable, err)
+		return 0, &QueryError{Table: OrganizationInviteTable, Op: "scanning count", Err: err}
 	}
 	return n, nil
 }
 
+func (q OrgInvitesQ) CountByStatus(ctx context.Context, organizationID uuid.UUID) (map[string]uint, error) {
+	query, args, err := q.counter.
+		Columns("status").
+		Where(sq.Eq{"organization_id": organizationID}).
+		GroupBy("status").
+		ToSql()
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationInviteTable, Op: "building count by status query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationInviteTable, Op: "executing count by status query", Err: err}
+	}
+	defer rows.Close()
+
+	out := make(map[string]uint)
+	for rows.Next() {
+		var status string
+		var n uint
+		if err = rows.Scan(&n, &status); err != nil {
+			return nil, &QueryError{Table: OrganizationInviteTable, Op: "scanning count by status", Err: err}
+		}
+		out[status] = n
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &QueryError{Table: OrganizationInviteTable, Op: "iterating rows", Err: err}
+	}
+
+	return out, nil
+}
+
 func (q OrgInvitesQ) Page(limit uint, offset uint) OrgInvitesQ {
 	q.selector = q.selector.Limit(uint64(limit)).Offset(uint64(offset))
 	return q
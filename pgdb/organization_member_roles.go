@@ -4,10 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/netbill/pgx"
 )
 
@@ -21,7 +21,7 @@ type OrganizationMemberRole struct {
 
 func (mr *OrganizationMemberRole) scan(row sq.RowScanner) error {
 	if err := row.Scan(&mr.MemberID, &mr.RoleID); err != nil {
-		return fmt.Errorf("scanning member_role: %w", err)
+		return &QueryError{Table: OrganizationMemberRoleTable, Op: "scanning row", Err: err}
 	}
 	return nil
 }
@@ -51,7 +51,7 @@ func (q OrgMemberRolesQ) Insert(ctx context.Context, data OrganizationMemberRole
 		"role_id":   data.RoleID,
 	}).Suffix("RETURNING " + OrganizationMemberRoleColumns).ToSql()
 	if err != nil {
-		return OrganizationMemberRole{}, fmt.Errorf("building insert query for %s: %w", OrganizationMemberRoleTable, err)
+		return OrganizationMemberRole{}, &QueryError{Table: OrganizationMemberRoleTable, Op: "building insert query", Err: err}
 	}
 
 	var out OrganizationMemberRole
@@ -64,14 +64,14 @@ func (q OrgMemberRolesQ) Insert(ctx context.Context, data OrganizationMemberRole
 func (q OrgMemberRolesQ) Get(ctx context.Context) (OrganizationMemberRole, error) {
 	query, args, err := q.selector.Limit(1).ToSql()
 	if err != nil {
-		return OrganizationMemberRole{}, fmt.Errorf("building select query for %s: %w", OrganizationMemberRoleTable, err)
+		return OrganizationMemberRole{}, &QueryError{Table: OrganizationMemberRoleTable, Op: "building select query", Err: err}
 	}
 
 	var out OrganizationMemberRole
 	if err = out.scan(q.db.QueryRowContext(ctx, query, args...)); err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return OrganizationMemberRole{}, nil
+			return OrganizationMemberRole{}, &QueryError{Table: OrganizationMemberRoleTable, Op: "getting row", Err: ErrNotFound}
 		default:
 			return OrganizationMemberRole{}, err
 		}
@@ -82,17 +82,23 @@ func (q OrgMemberRolesQ) Get(ctx context.Context) (OrganizationMemberRole, error
 func (q OrgMemberRolesQ) Select(ctx context.Context) ([]OrganizationMemberRole, error) {
 	query, args, err := q.selector.ToSql()
 	if err != nil {
-		return nil, fmt.Errorf("building select query for %s: %w", OrganizationMemberRoleTable, err)
+		return nil, &QueryError{Table: OrganizationMemberRoleTable, Op: "building select query", Err: err}
 	}
 
 	rows, err := q.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("executing select query for %s: %w", OrganizationMemberRoleTable, err)
+		return nil, &QueryError{Table: OrganizationMemberRoleTable, Op: "executing select query", Err: err}
 	}
 	defer rows.Close()
 
 	var out []OrganizationMemberRole
-	for rows.Next() {
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
 		var mr OrganizationMemberRole
 		if err = mr.scan(rows); err != nil {
 			return nil, err
@@ -100,36 +106,142 @@ func (q OrgMemberRolesQ) Select(ctx context.Context) ([]OrganizationMemberRole,
 		out = append(out, mr)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, &QueryError{Table: OrganizationMemberRoleTable, Op: "iterating rows", Err: err}
 	}
 
 	return out, nil
 }
 
+func (q OrgMemberRolesQ) Each(ctx context.Context, fn func(OrganizationMemberRole) error) error {
+	query, args, err := q.selector.ToSql()
+	if err != nil {
+		return &QueryError{Table: OrganizationMemberRoleTable, Op: "building select query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &QueryError{Table: OrganizationMemberRoleTable, Op: "executing select query", Err: err}
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		var mr OrganizationMemberRole
+		if err = mr.scan(rows); err != nil {
+			return err
+		}
+		if err = fn(mr); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return &QueryError{Table: OrganizationMemberRoleTable, Op: "iterating rows", Err: err}
+	}
+
+	return nil
+}
+
 func (q OrgMemberRolesQ) Delete(ctx context.Context) error {
+	_, err := q.DeleteReturning(ctx)
+	return err
+}
+
+func (q OrgMemberRolesQ) DeleteReturning(ctx context.Context) (int64, error) {
 	query, args, err := q.deleter.ToSql()
 	if err != nil {
-		return fmt.Errorf("building delete query for %s: %w", OrganizationMemberRoleTable, err)
+		return 0, &QueryError{Table: OrganizationMemberRoleTable, Op: "building delete query", Err: err}
 	}
-	if _, err = q.db.ExecContext(ctx, query, args...); err != nil {
-		return fmt.Errorf("executing delete query for %s: %w", OrganizationMemberRoleTable, err)
+
+	res, err := q.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationMemberRoleTable, Op: "executing delete query", Err: err}
 	}
-	return nil
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationMemberRoleTable, Op: "rows affected", Err: err}
+	}
+
+	return n, nil
+}
+
+func (q OrgMemberRolesQ) DeletePair(ctx context.Context, memberID, roleID uuid.UUID) (bool, error) {
+	query, args, err := NewOrgMemberRolesQ(q.db).deleter.
+		Where(sq.Eq{"member_id": memberID, "role_id": roleID}).
+		ToSql()
+	if err != nil {
+		return false, &QueryError{Table: OrganizationMemberRoleTable, Op: "building delete query", Err: err}
+	}
+
+	res, err := q.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, &QueryError{Table: OrganizationMemberRoleTable, Op: "executing delete query", Err: err}
+	}
+
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return false, &QueryError{Table: OrganizationMemberRoleTable, Op: "rows affected", Err: err}
+	}
+
+	return aff > 0, nil
 }
 
 func (q OrgMemberRolesQ) Count(ctx context.Context) (uint, error) {
 	query, args, err := q.counter.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building count query for %s: %w", OrganizationMemberRoleTable, err)
+		return 0, &QueryError{Table: OrganizationMemberRoleTable, Op: "building count query", Err: err}
 	}
 
 	var n uint
 	if err = q.db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
-		return 0, fmt.Errorf("scanning count for %s: %w", OrganizationMemberRoleTable, err)
+		return 0, &QueryError{Table: OrganizationMemberRoleTable, Op: "scanning count", Err: err}
 	}
 	return n, nil
 }
 
+func (q OrgMemberRolesQ) CountByMember(ctx context.Context, memberIDs []uuid.UUID) (map[uuid.UUID]uint, error) {
+	out := make(map[uuid.UUID]uint, len(memberIDs))
+	if len(memberIDs) == 0 {
+		return out, nil
+	}
+
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select("member_id", "COUNT(*)").
+		From(OrganizationMemberRoleTable).
+		Where(sq.Eq{"member_id": memberIDs}).
+		GroupBy("member_id").
+		ToSql()
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationMemberRoleTable, Op: "building count by member query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationMemberRoleTable, Op: "executing count by member query", Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var memberID uuid.UUID
+		var n uint
+		if err = rows.Scan(&memberID, &n); err != nil {
+			return nil, &QueryError{Table: OrganizationMemberRoleTable, Op: "scanning count by member", Err: err}
+		}
+		out[memberID] = n
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &QueryError{Table: OrganizationMemberRoleTable, Op: "iterating rows", Err: err}
+	}
+
+	return out, nil
+}
+
 func (q OrgMemberRolesQ) FilterByMemberID(memberID uuid.UUID) OrgMemberRolesQ {
 	q.selector = q.selector.Where(sq.Eq{"member_id": memberID})
 	q.counter = q.counter.Where(sq.Eq{"member_id": memberID})
@@ -143,3 +255,32 @@ func (q OrgMemberRolesQ) FilterByRoleID(roleID uuid.UUID) OrgMemberRolesQ {
 	q.deleter = q.deleter.Where(sq.Eq{"role_id": roleID})
 	return q
 }
+
+func (q OrgMemberRolesQ) ReplaceMemberRoles(ctx context.Context, memberID uuid.UUID, roleIDs []uuid.UUID) error {
+	// Runs as a single statement so the delete and insert are applied atomically.
+	// Roles kept in the new set are not deleted, which keeps head role links intact.
+	sqlq := `
+		WITH desired AS (
+			SELECT DISTINCT UNNEST($2::uuid[]) AS role_id
+		),
+		del AS (
+			DELETE FROM ` + OrganizationMemberRoleTable + `
+			WHERE member_id = $1
+			  AND role_id NOT IN (SELECT role_id FROM desired)
+		)
+		INSERT INTO ` + OrganizationMemberRoleTable + ` (member_id, role_id)
+		SELECT $1, role_id FROM desired
+		ON CONFLICT DO NOTHING
+	`
+
+	ids := make([]string, len(roleIDs))
+	for i, id := range roleIDs {
+		ids[i] = id.String()
+	}
+
+	if _, err := q.db.ExecContext(ctx, sqlq, memberID, pq.Array(ids)); err != nil {
+		return &QueryError{Table: OrganizationMemberRoleTable, Op: "replacing roles for member", Err: err}
+	}
+
+	return nil
+}
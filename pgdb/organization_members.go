@@ -4,10 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/netbill/pgx"
 
 	sq "github.com/Masterminds/squirrel"
@@ -39,7 +39,7 @@ func (m *OrganizationMember) scan(row sq.RowScanner) error {
 		&m.UpdatedAt,
 	)
 	if err != nil {
-		return fmt.Errorf("scanning member: %w", err)
+		return &QueryError{Table: OrganizationMembersTable, Op: "scanning row", Err: err}
 	}
 	return nil
 }
@@ -80,7 +80,7 @@ func (q OrgMembersQ) Insert(ctx context.Context, data InsertMemberParams) (Organ
 		"label":           data.Label,
 	}).Suffix("RETURNING " + OrganizationMemberColumns).ToSql()
 	if err != nil {
-		return OrganizationMember{}, fmt.Errorf("building insert query for %s: %w", OrganizationMembersTable, err)
+		return OrganizationMember{}, &QueryError{Table: OrganizationMembersTable, Op: "building insert query", Err: err}
 	}
 
 	var inserted OrganizationMember
@@ -92,6 +92,85 @@ func (q OrgMembersQ) Insert(ctx context.Context, data InsertMemberParams) (Organ
 	return inserted, nil
 }
 
+type UpsertMemberParams struct {
+	ID             uuid.UUID
+	AccountID      uuid.UUID
+	OrganizationID uuid.UUID
+	Position       *string
+	Label          *string
+}
+
+func (q OrgMembersQ) Upsert(ctx context.Context, data UpsertMemberParams) (OrganizationMember, error) {
+	query, args, err := q.inserter.
+		SetMap(map[string]interface{}{
+			"id":              data.ID,
+			"account_id":      data.AccountID,
+			"organization_id": data.OrganizationID,
+			"position":        data.Position,
+			"label":           data.Label,
+		}).
+		Suffix(`
+			ON CONFLICT (id) DO UPDATE SET
+				position = EXCLUDED.position,
+				label    = EXCLUDED.label,
+				updated_at = (now() at time zone 'utc')
+			RETURNING ` + OrganizationMemberColumns,
+		).
+		ToSql()
+	if err != nil {
+		return OrganizationMember{}, &QueryError{Table: OrganizationMembersTable, Op: "building upsert query", Err: err}
+	}
+
+	var result OrganizationMember
+	if err = result.scan(q.db.QueryRowContext(ctx, query, args...)); err != nil {
+		return OrganizationMember{}, err
+	}
+
+	return result, nil
+}
+
+func (q OrgMembersQ) InsertBatch(ctx context.Context, data []InsertMemberParams) ([]OrganizationMember, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	out := make([]OrganizationMember, 0, len(data))
+	for start := 0; start < len(data); start += insertBatchSize {
+		end := min(start+insertBatchSize, len(data))
+
+		ins := q.inserter.Columns("account_id", "organization_id", "position", "label")
+		for _, d := range data[start:end] {
+			ins = ins.Values(d.AccountID, d.OrganizationID, d.Position, d.Label)
+		}
+
+		query, args, err := ins.Suffix("RETURNING " + OrganizationMemberColumns).ToSql()
+		if err != nil {
+			return nil, &QueryError{Table: OrganizationMembersTable, Op: "building insert query", Err: err}
+		}
+
+		rows, err := q.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, &QueryError{Table: OrganizationMembersTable, Op: "executing insert query", Err: err}
+		}
+
+		for rows.Next() {
+			var m OrganizationMember
+			if err = m.scan(rows); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out = append(out, m)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, &QueryError{Table: OrganizationMembersTable, Op: "iterating rows", Err: err}
+		}
+	}
+
+	return out, nil
+}
+
 func (q OrgMembersQ) Exists(ctx context.Context) (bool, error) {
 	existsQ := q.selector.
 		Columns("1").
@@ -103,21 +182,25 @@ func (q OrgMembersQ) Exists(ctx context.Context) (bool, error) {
 
 	query, args, err := existsQ.ToSql()
 	if err != nil {
-		return false, fmt.Errorf("building exists query for %s: %w", OrganizationMembersTable, err)
+		return false, &QueryError{Table: OrganizationMembersTable, Op: "building exists query", Err: err}
 	}
 
 	var ok bool
 	if err = q.db.QueryRowContext(ctx, query, args...).Scan(&ok); err != nil {
-		return false, fmt.Errorf("scanning exists for %s: %w", OrganizationMembersTable, err)
+		return false, &QueryError{Table: OrganizationMembersTable, Op: "scanning exists", Err: err}
 	}
 
 	return ok, nil
 }
 
+func (q OrgMembersQ) ExistsForAccount(ctx context.Context, accountID, organizationID uuid.UUID) (bool, error) {
+	return q.FilterByAccountID(accountID).FilterByOrganizationID(organizationID).Exists(ctx)
+}
+
 func (q OrgMembersQ) Get(ctx context.Context) (OrganizationMember, error) {
 	query, args, err := q.selector.Limit(1).ToSql()
 	if err != nil {
-		return OrganizationMember{}, fmt.Errorf("building select query for %s: %w", OrganizationMembersTable, err)
+		return OrganizationMember{}, &QueryError{Table: OrganizationMembersTable, Op: "building select query", Err: err}
 	}
 
 	var m OrganizationMember
@@ -125,7 +208,7 @@ func (q OrgMembersQ) Get(ctx context.Context) (OrganizationMember, error) {
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return OrganizationMember{}, nil
+			return OrganizationMember{}, &QueryError{Table: OrganizationMembersTable, Op: "getting row", Err: ErrNotFound}
 		default:
 			return OrganizationMember{}, err
 		}
@@ -134,20 +217,30 @@ func (q OrgMembersQ) Get(ctx context.Context) (OrganizationMember, error) {
 	return m, nil
 }
 
+func (q OrgMembersQ) GetByID(ctx context.Context, id uuid.UUID) (OrganizationMember, error) {
+	return q.FilterByID(id).Get(ctx)
+}
+
 func (q OrgMembersQ) Select(ctx context.Context) ([]OrganizationMember, error) {
 	query, args, err := q.selector.ToSql()
 	if err != nil {
-		return nil, fmt.Errorf("building select query for %s: %w", OrganizationMembersTable, err)
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "building select query", Err: err}
 	}
 
 	rows, err := q.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("executing select query for %s: %w", OrganizationMembersTable, err)
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "executing select query", Err: err}
 	}
 	defer rows.Close()
 
 	var out []OrganizationMember
-	for rows.Next() {
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
 		var m OrganizationMember
 		if err = m.scan(rows); err != nil {
 			return nil, err
@@ -155,7 +248,152 @@ func (q OrgMembersQ) Select(ctx context.Context) ([]OrganizationMember, error) {
 		out = append(out, m)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "iterating rows", Err: err}
+	}
+
+	return out, nil
+}
+
+func (q OrgMembersQ) Each(ctx context.Context, fn func(OrganizationMember) error) error {
+	query, args, err := q.selector.ToSql()
+	if err != nil {
+		return &QueryError{Table: OrganizationMembersTable, Op: "building select query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &QueryError{Table: OrganizationMembersTable, Op: "executing select query", Err: err}
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		var m OrganizationMember
+		if err = m.scan(rows); err != nil {
+			return err
+		}
+		if err = fn(m); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return &QueryError{Table: OrganizationMembersTable, Op: "iterating rows", Err: err}
+	}
+
+	return nil
+}
+
+type OrganizationMemberWithProfile struct {
+	OrganizationMember
+	Username  string  `json:"username"`
+	Pseudonym *string `json:"pseudonym,omitempty"`
+	Official  bool    `json:"official"`
+}
+
+func (q OrgMembersQ) SelectWithProfile(ctx context.Context) ([]OrganizationMemberWithProfile, error) {
+	query, args, err := q.selector.
+		Columns("p.username", "p.pseudonym", "p.official").
+		Join(ProfileTable + " p ON p.account_id = m.account_id").
+		ToSql()
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "building select with profile query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "executing select with profile query", Err: err}
+	}
+	defer rows.Close()
+
+	var out []OrganizationMemberWithProfile
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		var m OrganizationMemberWithProfile
+		err = rows.Scan(
+			&m.ID,
+			&m.AccountID,
+			&m.OrganizationID,
+			&m.Position,
+			&m.Label,
+			&m.CreatedAt,
+			&m.UpdatedAt,
+			&m.Username,
+			&m.Pseudonym,
+			&m.Official,
+		)
+		if err != nil {
+			return nil, &QueryError{Table: OrganizationMembersTable, Op: "scanning row", Err: err}
+		}
+		out = append(out, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "iterating rows", Err: err}
+	}
+
+	return out, nil
+}
+
+type OrganizationMemberWithRoles struct {
+	OrganizationMember
+	RoleIDs []uuid.UUID `json:"role_ids"`
+}
+
+func (q OrgMembersQ) SelectWithRoleIDs(ctx context.Context) ([]OrganizationMemberWithRoles, error) {
+	query, args, err := q.selector.
+		Column("COALESCE(array_agg(mr.role_id) FILTER (WHERE mr.role_id IS NOT NULL), '{}') AS role_ids").
+		LeftJoin(OrganizationMemberRoleTable + " mr ON mr.member_id = m.id").
+		GroupBy("m.id").
+		ToSql()
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "building select with roles query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "executing select with roles query", Err: err}
+	}
+	defer rows.Close()
+
+	var out []OrganizationMemberWithRoles
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		var m OrganizationMemberWithRoles
+		err = rows.Scan(
+			&m.ID,
+			&m.AccountID,
+			&m.OrganizationID,
+			&m.Position,
+			&m.Label,
+			&m.CreatedAt,
+			&m.UpdatedAt,
+			pq.Array(&m.RoleIDs),
+		)
+		if err != nil {
+			return nil, &QueryError{Table: OrganizationMembersTable, Op: "scanning row", Err: err}
+		}
+		if m.RoleIDs == nil {
+			m.RoleIDs = []uuid.UUID{}
+		}
+		out = append(out, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "iterating rows", Err: err}
 	}
 
 	return out, nil
@@ -177,6 +415,22 @@ func (q OrgMembersQ) FilterByAccountID(accountID uuid.UUID) OrgMembersQ {
 	return q
 }
 
+func (q OrgMembersQ) FilterByAccountIDs(ids ...uuid.UUID) OrgMembersQ {
+	if len(ids) == 0 {
+		q.selector = q.selector.Where(sq.Expr("1=0"))
+		q.counter = q.counter.Where(sq.Expr("1=0"))
+		q.updater = q.updater.Where(sq.Expr("1=0"))
+		q.deleter = q.deleter.Where(sq.Expr("1=0"))
+		return q
+	}
+
+	q.selector = q.selector.Where(sq.Eq{"m.account_id": ids})
+	q.counter = q.counter.Where(sq.Eq{"m.account_id": ids})
+	q.updater = q.updater.Where(sq.Eq{"m.account_id": ids})
+	q.deleter = q.deleter.Where(sq.Eq{"m.account_id": ids})
+	return q
+}
+
 func (q OrgMembersQ) FilterByOrganizationID(organizationID uuid.UUID) OrgMembersQ {
 	q.selector = q.selector.Where(sq.Eq{"m.organization_id": organizationID})
 	q.counter = q.counter.Where(sq.Eq{"m.organization_id": organizationID})
@@ -201,12 +455,38 @@ func (q OrgMembersQ) FilterLikeLabel(label string) OrgMembersQ {
 	return q
 }
 
+func (q OrgMembersQ) FilterPositionNull(isNull bool) OrgMembersQ {
+	var expr sq.Sqlizer = sq.NotEq{"m.position": nil}
+	if isNull {
+		expr = sq.Eq{"m.position": nil}
+	}
+
+	q.selector = q.selector.Where(expr)
+	q.counter = q.counter.Where(expr)
+	q.updater = q.updater.Where(expr)
+	q.deleter = q.deleter.Where(expr)
+	return q
+}
+
+func (q OrgMembersQ) FilterLabelNull(isNull bool) OrgMembersQ {
+	var expr sq.Sqlizer = sq.NotEq{"m.label": nil}
+	if isNull {
+		expr = sq.Eq{"m.label": nil}
+	}
+
+	q.selector = q.selector.Where(expr)
+	q.counter = q.counter.Where(expr)
+	q.updater = q.updater.Where(expr)
+	q.deleter = q.deleter.Where(expr)
+	return q
+}
+
 func (q OrgMembersQ) UpdateOne(ctx context.Context) (OrganizationMember, error) {
 	q.updater = q.updater.Set("updated_at", time.Now().UTC())
 
 	query, args, err := q.updater.Suffix("RETURNING " + OrganizationMemberColumns).ToSql()
 	if err != nil {
-		return OrganizationMember{}, fmt.Errorf("building update query for %s: %w", OrganizationMembersTable, err)
+		return OrganizationMember{}, &QueryError{Table: OrganizationMembersTable, Op: "building update query", Err: err}
 	}
 
 	var updated OrganizationMember
@@ -223,17 +503,17 @@ func (q OrgMembersQ) UpdateMany(ctx context.Context) (int64, error) {
 
 	query, args, err := q.updater.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building update query for %s: %w", OrganizationMembersTable, err)
+		return 0, &QueryError{Table: OrganizationMembersTable, Op: "building update query", Err: err}
 	}
 
 	res, err := q.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return 0, fmt.Errorf("executing update query for %s: %w", OrganizationMembersTable, err)
+		return 0, &QueryError{Table: OrganizationMembersTable, Op: "executing update query", Err: err}
 	}
 
 	affected, err := res.RowsAffected()
 	if err != nil {
-		return 0, fmt.Errorf("rows affected for %s: %w", OrganizationMembersTable, err)
+		return 0, &QueryError{Table: OrganizationMembersTable, Op: "rows affected", Err: err}
 	}
 
 	return affected, nil
@@ -249,36 +529,120 @@ func (q OrgMembersQ) UpdateLabel(label sql.NullString) OrgMembersQ {
 	return q
 }
 
+func (q OrgMembersQ) UpdatePositionPtr(position *string) OrgMembersQ {
+	q.updater = q.updater.Set("position", position)
+	return q
+}
+
+func (q OrgMembersQ) UpdateLabelPtr(label *string) OrgMembersQ {
+	q.updater = q.updater.Set("label", label)
+	return q
+}
+
 func (q OrgMembersQ) Delete(ctx context.Context) error {
+	_, err := q.DeleteReturning(ctx)
+	return err
+}
+
+func (q OrgMembersQ) DeleteReturning(ctx context.Context) (int64, error) {
 	query, args, err := q.deleter.ToSql()
 	if err != nil {
-		return fmt.Errorf("building delete query for %s: %w", OrganizationMembersTable, err)
+		return 0, &QueryError{Table: OrganizationMembersTable, Op: "building delete query", Err: err}
 	}
 
-	_, err = q.db.ExecContext(ctx, query, args...)
+	res, err := q.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("executing delete query for %s: %w", OrganizationMembersTable, err)
+		return 0, &QueryError{Table: OrganizationMembersTable, Op: "executing delete query", Err: err}
 	}
 
-	return nil
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationMembersTable, Op: "rows affected", Err: err}
+	}
+
+	return affected, nil
 }
 
 func (q OrgMembersQ) Count(ctx context.Context) (uint, error) {
 	query, args, err := q.counter.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building count query for %s: %w", OrganizationMembersTable, err)
+		return 0, &QueryError{Table: OrganizationMembersTable, Op: "building count query", Err: err}
 	}
 
 	var count uint
 	err = q.db.QueryRowContext(ctx, query, args...).Scan(&count)
 	if err != nil {
-		return 0, fmt.Errorf("scanning count for %s: %w", OrganizationMembersTable, err)
+		return 0, &QueryError{Table: OrganizationMembersTable, Op: "scanning count", Err: err}
 	}
 
 	return count, nil
 }
 
+func (q OrgMembersQ) CountByOrganization(ctx context.Context, orgIDs []uuid.UUID) (map[uuid.UUID]uint, error) {
+	out := make(map[uuid.UUID]uint, len(orgIDs))
+	if len(orgIDs) == 0 {
+		return out, nil
+	}
+
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select("organization_id", "COUNT(*)").
+		From(OrganizationMembersTable).
+		Where(sq.Eq{"organization_id": orgIDs}).
+		GroupBy("organization_id").
+		ToSql()
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "building count by organization query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "executing count by organization query", Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var organizationID uuid.UUID
+		var count uint
+		if err = rows.Scan(&organizationID, &count); err != nil {
+			return nil, &QueryError{Table: OrganizationMembersTable, Op: "scanning count by organization", Err: err}
+		}
+		out[organizationID] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &QueryError{Table: OrganizationMembersTable, Op: "iterating rows", Err: err}
+	}
+
+	return out, nil
+}
+
 func (q OrgMembersQ) Page(limit uint, offset uint) OrgMembersQ {
 	q.selector = q.selector.Limit(uint64(limit)).Offset(uint64(offset))
 	return q
 }
+
+func (q OrgMembersQ) OrderByCreatedAt(asc bool) OrgMembersQ {
+	if asc {
+		q.selector = q.selector.OrderBy("m.created_at ASC", "m.id ASC")
+	} else {
+		q.selector = q.selector.OrderBy("m.created_at DESC", "m.id DESC")
+	}
+	return q
+}
+
+func (q OrgMembersQ) CursorCreatedAt(limit uint, asc bool, createdAt time.Time, id uuid.UUID) OrgMembersQ {
+	q = q.OrderByCreatedAt(asc)
+	q.selector = q.selector.Limit(uint64(limit))
+
+	// empty cursor means the first page
+	if id == uuid.Nil {
+		return q
+	}
+
+	if asc {
+		q.selector = q.selector.Where(sq.Expr("(m.created_at, m.id) > (?, ?)", createdAt, id))
+	} else {
+		q.selector = q.selector.Where(sq.Expr("(m.created_at, m.id) < (?, ?)", createdAt, id))
+	}
+
+	return q
+}
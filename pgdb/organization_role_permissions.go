@@ -4,14 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/google/uuid"
 	"github.com/netbill/pgx"
 )
 
-const OrganizationPermissionTable = "organization_role_permission"
+const OrganizationPermissionTable = "organization_role_permissions"
 const OrganizationPermissionColumns = "id, code"
 
 type OrganizationRolePermission struct {
@@ -21,7 +20,7 @@ type OrganizationRolePermission struct {
 
 func (p *OrganizationRolePermission) scan(row sq.RowScanner) error {
 	if err := row.Scan(&p.ID, &p.Code); err != nil {
-		return fmt.Errorf("scanning permission: %w", err)
+		return &QueryError{Table: OrganizationPermissionTable, Op: "scanning row", Err: err}
 	}
 	return nil
 }
@@ -53,7 +52,7 @@ func (q OrgRolePermissionsQ) Insert(ctx context.Context, data OrganizationRolePe
 		"code": data.Code,
 	}).Suffix("RETURNING " + OrganizationPermissionColumns).ToSql()
 	if err != nil {
-		return OrganizationRolePermission{}, fmt.Errorf("building insert query for %s: %w", OrganizationPermissionTable, err)
+		return OrganizationRolePermission{}, &QueryError{Table: OrganizationPermissionTable, Op: "building insert query", Err: err}
 	}
 
 	var out OrganizationRolePermission
@@ -63,17 +62,39 @@ func (q OrgRolePermissionsQ) Insert(ctx context.Context, data OrganizationRolePe
 	return out, nil
 }
 
+func (q OrgRolePermissionsQ) EnsureCodes(ctx context.Context, codes []string) ([]OrganizationRolePermission, error) {
+	if len(codes) == 0 {
+		return nil, nil
+	}
+
+	ins := q.inserter.Columns("id", "code")
+	for _, code := range codes {
+		ins = ins.Values(uuid.New(), code)
+	}
+
+	query, args, err := ins.Suffix("ON CONFLICT (code) DO NOTHING").ToSql()
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationPermissionTable, Op: "building insert query", Err: err}
+	}
+
+	if _, err = q.db.ExecContext(ctx, query, args...); err != nil {
+		return nil, &QueryError{Table: OrganizationPermissionTable, Op: "executing insert query", Err: err}
+	}
+
+	return NewOrgPermissionsQ(q.db).FilterByCode(codes...).Select(ctx)
+}
+
 func (q OrgRolePermissionsQ) Get(ctx context.Context) (OrganizationRolePermission, error) {
 	query, args, err := q.selector.Limit(1).ToSql()
 	if err != nil {
-		return OrganizationRolePermission{}, fmt.Errorf("building select query for %s: %w", OrganizationPermissionTable, err)
+		return OrganizationRolePermission{}, &QueryError{Table: OrganizationPermissionTable, Op: "building select query", Err: err}
 	}
 
 	var out OrganizationRolePermission
 	if err = out.scan(q.db.QueryRowContext(ctx, query, args...)); err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return OrganizationRolePermission{}, nil
+			return OrganizationRolePermission{}, &QueryError{Table: OrganizationPermissionTable, Op: "getting row", Err: ErrNotFound}
 		default:
 			return OrganizationRolePermission{}, err
 		}
@@ -84,17 +105,23 @@ func (q OrgRolePermissionsQ) Get(ctx context.Context) (OrganizationRolePermissio
 func (q OrgRolePermissionsQ) Select(ctx context.Context) ([]OrganizationRolePermission, error) {
 	query, args, err := q.selector.ToSql()
 	if err != nil {
-		return nil, fmt.Errorf("building select query for %s: %w", OrganizationPermissionTable, err)
+		return nil, &QueryError{Table: OrganizationPermissionTable, Op: "building select query", Err: err}
 	}
 
 	rows, err := q.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("executing select query for %s: %w", OrganizationPermissionTable, err)
+		return nil, &QueryError{Table: OrganizationPermissionTable, Op: "executing select query", Err: err}
 	}
 	defer rows.Close()
 
 	var out []OrganizationRolePermission
-	for rows.Next() {
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
 		var p OrganizationRolePermission
 		if err = p.scan(rows); err != nil {
 			return nil, err
@@ -102,16 +129,51 @@ func (q OrgRolePermissionsQ) Select(ctx context.Context) ([]OrganizationRolePerm
 		out = append(out, p)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, &QueryError{Table: OrganizationPermissionTable, Op: "iterating rows", Err: err}
 	}
 
 	return out, nil
 }
 
+func (q OrgRolePermissionsQ) Each(ctx context.Context, fn func(OrganizationRolePermission) error) error {
+	query, args, err := q.selector.ToSql()
+	if err != nil {
+		return &QueryError{Table: OrganizationPermissionTable, Op: "building select query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &QueryError{Table: OrganizationPermissionTable, Op: "executing select query", Err: err}
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		var p OrganizationRolePermission
+		if err = p.scan(rows); err != nil {
+			return err
+		}
+		if err = fn(p); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return &QueryError{Table: OrganizationPermissionTable, Op: "iterating rows", Err: err}
+	}
+
+	return nil
+}
+
 func (q OrgRolePermissionsQ) UpdateOne(ctx context.Context) (OrganizationRolePermission, error) {
 	query, args, err := q.updater.Suffix("RETURNING " + OrganizationPermissionColumns).ToSql()
 	if err != nil {
-		return OrganizationRolePermission{}, fmt.Errorf("building update query for %s: %w", OrganizationPermissionTable, err)
+		return OrganizationRolePermission{}, &QueryError{Table: OrganizationPermissionTable, Op: "building update query", Err: err}
 	}
 
 	var out OrganizationRolePermission
@@ -124,30 +186,56 @@ func (q OrgRolePermissionsQ) UpdateOne(ctx context.Context) (OrganizationRolePer
 func (q OrgRolePermissionsQ) UpdateMany(ctx context.Context) (int64, error) {
 	query, args, err := q.updater.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building update query for %s: %w", OrganizationPermissionTable, err)
+		return 0, &QueryError{Table: OrganizationPermissionTable, Op: "building update query", Err: err}
 	}
 
 	res, err := q.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return 0, fmt.Errorf("executing update query for %s: %w", OrganizationPermissionTable, err)
+		return 0, &QueryError{Table: OrganizationPermissionTable, Op: "executing update query", Err: err}
 	}
 
 	n, err := res.RowsAffected()
 	if err != nil {
-		return 0, fmt.Errorf("rows affected for %s: %w", OrganizationPermissionTable, err)
+		return 0, &QueryError{Table: OrganizationPermissionTable, Op: "rows affected", Err: err}
 	}
 	return n, nil
 }
 
 func (q OrgRolePermissionsQ) Delete(ctx context.Context) error {
+	_, err := q.DeleteReturning(ctx)
+	return err
+}
+
+func (q OrgRolePermissionsQ) DeleteReturning(ctx context.Context) (int64, error) {
 	query, args, err := q.deleter.ToSql()
 	if err != nil {
-		return fmt.Errorf("building delete query for %s: %w", OrganizationPermissionTable, err)
+		return 0, &QueryError{Table: OrganizationPermissionTable, Op: "building delete query", Err: err}
 	}
-	if _, err = q.db.ExecContext(ctx, query, args...); err != nil {
-		return fmt.Errorf("executing delete query for %s: %w", OrganizationPermissionTable, err)
+
+	res, err := q.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationPermissionTable, Op: "executing delete query", Err: err}
 	}
-	return nil
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationPermissionTable, Op: "rows affected", Err: err}
+	}
+
+	return n, nil
+}
+
+func (q OrgRolePermissionsQ) Count(ctx context.Context) (uint, error) {
+	query, args, err := q.counter.ToSql()
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationPermissionTable, Op: "building count query", Err: err}
+	}
+
+	var n uint
+	if err = q.db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		return 0, &QueryError{Table: OrganizationPermissionTable, Op: "scanning count", Err: err}
+	}
+	return n, nil
 }
 
 func (q OrgRolePermissionsQ) FilterByID(id uuid.UUID) OrgRolePermissionsQ {
@@ -167,13 +255,15 @@ func (q OrgRolePermissionsQ) FilterByCode(code ...string) OrgRolePermissionsQ {
 }
 
 func (q OrgRolePermissionsQ) FilterByRoleID(roleID uuid.UUID) OrgRolePermissionsQ {
+	join := OrganizationRolePermissionsTable + " rp ON rp.permission_id = " + OrganizationPermissionTable + ".id"
+
 	q.selector = q.selector.
-		Join("organization_role_permission_links rp ON rp.permission_id = role_permissions.id").
+		Join(join).
 		Where(sq.Eq{"rp.role_id": roleID}).
 		Distinct()
 
 	q.counter = q.counter.
-		Join("organization_role_permission_links rp ON rp.permission_id = role_permissions.id").
+		Join(join).
 		Where(sq.Eq{"rp.role_id": roleID})
 
 	return q
@@ -185,18 +275,32 @@ func (q OrgRolePermissionsQ) FilterLikeDescription(description string) OrgRolePe
 	return q
 }
 
+func (q OrgRolePermissionsQ) OrderByCode(asc bool) OrgRolePermissionsQ {
+	if asc {
+		q.selector = q.selector.OrderBy("code ASC", "id ASC")
+	} else {
+		q.selector = q.selector.OrderBy("code DESC", "id DESC")
+	}
+	return q
+}
+
+func (q OrgRolePermissionsQ) Page(limit, offset uint) OrgRolePermissionsQ {
+	q.selector = q.selector.Limit(uint64(limit)).Offset(uint64(offset))
+	return q
+}
+
 func (q OrgRolePermissionsQ) GetForRole(
 	ctx context.Context,
 	roleID uuid.UUID,
 ) (map[OrganizationRolePermission]bool, error) {
 
-	const sqlq = `
+	sqlq := `
 		SELECT
 			p.id,
 			p.code,
 			(rp.permission_id IS NOT NULL) AS enabled
-		FROM organization_role_permissions p
-		LEFT JOIN organization_role_permission_links rp
+		FROM ` + OrganizationPermissionTable + ` p
+		LEFT JOIN ` + OrganizationRolePermissionsTable + ` rp
 			ON rp.permission_id = p.id
 			AND rp.role_id = $1
 		ORDER BY p.code
@@ -204,7 +308,7 @@ func (q OrgRolePermissionsQ) GetForRole(
 
 	rows, err := q.db.QueryContext(ctx, sqlq, roleID)
 	if err != nil {
-		return nil, fmt.Errorf("query organization_role_permissions for role: %w", err)
+		return nil, &QueryError{Table: OrganizationPermissionTable, Op: "executing select query", Err: err}
 	}
 	defer rows.Close()
 
@@ -219,15 +323,77 @@ func (q OrgRolePermissionsQ) GetForRole(
 			&p.Code,
 			&enabled,
 		); err != nil {
-			return nil, fmt.Errorf("scanning permission for role: %w", err)
+			return nil, &QueryError{Table: OrganizationPermissionTable, Op: "scanning row", Err: err}
 		}
 
 		out[p] = enabled
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, &QueryError{Table: OrganizationPermissionTable, Op: "iterating rows", Err: err}
 	}
 
 	return out, nil
 }
+
+func (q OrgRolePermissionsQ) ResolveAccountPermissions(
+	ctx context.Context,
+	accountID, organizationID uuid.UUID,
+) ([]string, error) {
+	sqlq := `
+		SELECT DISTINCT p.code
+		FROM ` + OrganizationMembersTable + ` m
+		JOIN ` + OrganizationMemberRoleTable + ` mr ON mr.member_id = m.id
+		JOIN ` + OrganizationRolePermissionsTable + ` rp ON rp.role_id = mr.role_id
+		JOIN ` + OrganizationPermissionTable + ` p ON p.id = rp.permission_id
+		WHERE m.account_id = $1
+		  AND m.organization_id = $2
+		ORDER BY p.code
+	`
+
+	rows, err := q.db.QueryContext(ctx, sqlq, accountID, organizationID)
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationPermissionTable, Op: "executing select query", Err: err}
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var code string
+		if err = rows.Scan(&code); err != nil {
+			return nil, &QueryError{Table: OrganizationPermissionTable, Op: "scanning row", Err: err}
+		}
+		out = append(out, code)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &QueryError{Table: OrganizationPermissionTable, Op: "iterating rows", Err: err}
+	}
+
+	return out, nil
+}
+
+func (q OrgRolePermissionsQ) AccountHasPermission(
+	ctx context.Context,
+	accountID, organizationID uuid.UUID,
+	code string,
+) (bool, error) {
+	sqlq := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM ` + OrganizationMembersTable + ` m
+			JOIN ` + OrganizationMemberRoleTable + ` mr ON mr.member_id = m.id
+			JOIN ` + OrganizationRolePermissionsTable + ` rp ON rp.role_id = mr.role_id
+			JOIN ` + OrganizationPermissionTable + ` p ON p.id = rp.permission_id
+			WHERE m.account_id = $1
+			  AND m.organization_id = $2
+			  AND p.code = $3
+		)
+	`
+
+	var ok bool
+	if err := q.db.QueryRowContext(ctx, sqlq, accountID, organizationID, code).Scan(&ok); err != nil {
+		return false, &QueryError{Table: OrganizationPermissionTable, Op: "scanning account permission exists", Err: err}
+	}
+
+	return ok, nil
+}
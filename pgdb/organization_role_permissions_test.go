@@ -0,0 +1,84 @@
+package pgdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestOrgRolePermissionsQFilterByRoleID(t *testing.T) {
+	roleID := uuid.New()
+	q := NewOrgPermissionsQ(nil).FilterByRoleID(roleID)
+
+	wantJoin := "JOIN " + OrganizationRolePermissionsTable + " rp ON rp.permission_id = " + OrganizationPermissionTable + ".id"
+	wantWhere := "WHERE rp.role_id = $1"
+
+	for name, b := range map[string]interface {
+		ToSql() (string, []any, error)
+	}{
+		"select": q.selector,
+		"count":  q.counter,
+	} {
+		query, args, err := b.ToSql()
+		if err != nil {
+			t.Fatalf("building %s: %v", name, err)
+		}
+		if !strings.Contains(query, wantJoin) {
+			t.Errorf("%s query %q does not contain %q", name, query, wantJoin)
+		}
+		if !strings.Contains(query, wantWhere) {
+			t.Errorf("%s query %q does not contain %q", name, query, wantWhere)
+		}
+		if !reflect.DeepEqual(args, []any{roleID.String()}) {
+			t.Errorf("%s args = %v, want [%s]", name, args, roleID)
+		}
+	}
+}
+
+func TestOrgRolePermissionsQGetForRole(t *testing.T) {
+	roleID := uuid.New()
+	read := OrganizationRolePermission{ID: uuid.New(), Code: "org.read"}
+	write := OrganizationRolePermission{ID: uuid.New(), Code: "org.write"}
+	manage := OrganizationRolePermission{ID: uuid.New(), Code: "roles.manage"}
+
+	conn := &stubConn{
+		columns: []string{"id", "code", "enabled"},
+		rows: [][]driver.Value{
+			{read.ID.String(), read.Code, true},
+			{write.ID.String(), write.Code, false},
+			{manage.ID.String(), manage.Code, true},
+		},
+	}
+
+	got, err := NewOrgPermissionsQ(newStubDB(t, conn)).GetForRole(context.Background(), roleID)
+	if err != nil {
+		t.Fatalf("GetForRole: %v", err)
+	}
+
+	want := map[OrganizationRolePermission]bool{
+		read:   true,
+		write:  false,
+		manage: true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetForRole = %v, want %v", got, want)
+	}
+
+	for _, part := range []string{
+		"FROM " + OrganizationPermissionTable + " p",
+		"LEFT JOIN " + OrganizationRolePermissionsTable + " rp",
+		"ON rp.permission_id = p.id",
+		"AND rp.role_id = $1",
+	} {
+		if !strings.Contains(conn.query, part) {
+			t.Errorf("query %q does not contain %q", conn.query, part)
+		}
+	}
+	if len(conn.args) != 1 || conn.args[0].Value != roleID.String() {
+		t.Errorf("args = %v, want [%s]", conn.args, roleID)
+	}
+}
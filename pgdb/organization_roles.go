@@ -44,7 +44,7 @@ func (r *OrganizationRole) scan(row sq.RowScanner) error {
 	)
 
 	if err != nil {
-		return fmt.Errorf("scanning role: %w", err)
+		return &QueryError{Table: OrganizationRoleTable, Op: "scanning row", Err: err}
 	}
 	return nil
 }
@@ -79,19 +79,28 @@ type InsertRoleParams struct {
 }
 
 func (q OrgRolesQ) Insert(ctx context.Context, data InsertRoleParams) (OrganizationRole, error) {
+	// Nothing is bumped or inserted unless the rank is within [0, count],
+	// so ranks stay contiguous.
 	const sqlInsertAtRank = `
-		WITH bumped AS (
+		WITH cnt AS (
+			SELECT COUNT(*)::int AS n
+			FROM organization_roles
+			WHERE organization_id = $1
+		),
+		bumped AS (
 			UPDATE organization_roles
 			SET
 				rank = rank + 1,
 				updated_at = now()
 			WHERE organization_id = $1
 			  AND rank >= $2
+			  AND $2 <= (SELECT n FROM cnt)
 			RETURNING 1
 		),
 		ins AS (
 			INSERT INTO organization_roles (organization_id, head, rank, name, color)
-			VALUES ($1, $3, $2, $4, $5)
+			SELECT $1::uuid, $3::boolean, $2::int, $4::text, $5::text
+			WHERE $2 <= (SELECT n FROM cnt)
 			RETURNING id, organization_id, head, rank, name, color, created_at, updated_at
 		)
 		SELECT id, organization_id, head, rank, name, color, created_at, updated_at
@@ -108,23 +117,122 @@ func (q OrgRolesQ) Insert(ctx context.Context, data InsertRoleParams) (Organizat
 
 	var inserted OrganizationRole
 	if err := inserted.scan(q.db.QueryRowContext(ctx, sqlInsertAtRank, args...)); err != nil {
-		return OrganizationRole{}, fmt.Errorf("insert role at rank: %w", err)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return OrganizationRole{}, fmt.Errorf("insert role at rank %d: %w", data.Rank, ErrRankOutOfRange)
+		default:
+			return OrganizationRole{}, fmt.Errorf("insert role at rank: %w", err)
+		}
 	}
 
 	return inserted, nil
 }
 
+// InsertDefaults inserts a block of roles for an organization that has no roles yet.
+// Ranks must form exactly 0..n-1; it returns ErrOrganizationHasRoles if the organization already has roles.
+func (q OrgRolesQ) InsertDefaults(
+	ctx context.Context,
+	organizationID uuid.UUID,
+	roles []InsertRoleParams,
+) ([]OrganizationRole, error) {
+	if len(roles) == 0 {
+		return nil, nil
+	}
+
+	n := uint(len(roles))
+	seen := make([]bool, n)
+	for _, r := range roles {
+		if r.Rank >= n {
+			return nil, fmt.Errorf("%w: rank %d out of range [0..%d]", ErrRankOutOfRange, r.Rank, n-1)
+		}
+		if seen[r.Rank] {
+			return nil, fmt.Errorf("%w: duplicate rank %d", ErrInvalidRolesRanks, r.Rank)
+		}
+		seen[r.Rank] = true
+	}
+
+	// The NOT EXISTS guard keeps a second block of 0..n-1 ranks from landing
+	// next to roles the organization already has.
+	sqlInsert := `
+		INSERT INTO ` + OrganizationRoleTable + ` (organization_id, head, rank, name, color)
+		SELECT $1, v.head, v.rank, v.name, v.color
+		FROM UNNEST($2::bool[], $3::int[], $4::text[], $5::text[]) AS v(head, rank, name, color)
+		WHERE NOT EXISTS (
+			SELECT 1 FROM ` + OrganizationRoleTable + ` WHERE organization_id = $1
+		)
+		RETURNING ` + OrganizationRoleColumns + `
+	`
+
+	heads := make([]bool, n)
+	ranks := make([]int, n)
+	names := make([]string, n)
+	colors := make([]string, n)
+	for i, r := range roles {
+		heads[i] = r.Head
+		ranks[i] = int(r.Rank)
+		names[i] = r.Name
+		colors[i] = r.Color
+	}
+
+	rows, err := q.db.QueryContext(ctx, sqlInsert,
+		organizationID, pq.Array(heads), pq.Array(ranks), pq.Array(names), pq.Array(colors),
+	)
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationRoleTable, Op: "executing insert query", Err: err}
+	}
+	defer rows.Close()
+
+	out := make([]OrganizationRole, 0, n)
+	for rows.Next() {
+		var r OrganizationRole
+		if err = r.scan(rows); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &QueryError{Table: OrganizationRoleTable, Op: "iterating rows", Err: err}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: organization %s", ErrOrganizationHasRoles, organizationID)
+	}
+
+	return out, nil
+}
+
+func (q OrgRolesQ) Exists(ctx context.Context) (bool, error) {
+	existsQ := q.selector.
+		Columns("1").
+		RemoveLimit().
+		RemoveOffset().
+		Prefix("SELECT EXISTS (").
+		Suffix(") AS exists").
+		Limit(1)
+
+	query, args, err := existsQ.ToSql()
+	if err != nil {
+		return false, &QueryError{Table: OrganizationRoleTable, Op: "building exists query", Err: err}
+	}
+
+	var ok bool
+	if err = q.db.QueryRowContext(ctx, query, args...).Scan(&ok); err != nil {
+		return false, &QueryError{Table: OrganizationRoleTable, Op: "scanning exists", Err: err}
+	}
+
+	return ok, nil
+}
+
 func (q OrgRolesQ) Get(ctx context.Context) (OrganizationRole, error) {
 	query, args, err := q.selector.Limit(1).ToSql()
 	if err != nil {
-		return OrganizationRole{}, fmt.Errorf("building select query for %s: %w", OrganizationRoleTable, err)
+		return OrganizationRole{}, &QueryError{Table: OrganizationRoleTable, Op: "building select query", Err: err}
 	}
 
 	var r OrganizationRole
 	if err = r.scan(q.db.QueryRowContext(ctx, query, args...)); err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return OrganizationRole{}, nil
+			return OrganizationRole{}, &QueryError{Table: OrganizationRoleTable, Op: "getting row", Err: ErrNotFound}
 		default:
 			return OrganizationRole{}, err
 		}
@@ -133,20 +241,30 @@ func (q OrgRolesQ) Get(ctx context.Context) (OrganizationRole, error) {
 	return r, nil
 }
 
+func (q OrgRolesQ) GetByID(ctx context.Context, id uuid.UUID) (OrganizationRole, error) {
+	return q.FilterByID(id).Get(ctx)
+}
+
 func (q OrgRolesQ) Select(ctx context.Context) ([]OrganizationRole, error) {
 	query, args, err := q.selector.ToSql()
 	if err != nil {
-		return nil, fmt.Errorf("building select query for %s: %w", OrganizationRoleTable, err)
+		return nil, &QueryError{Table: OrganizationRoleTable, Op: "building select query", Err: err}
 	}
 
 	rows, err := q.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("executing select query for %s: %w", OrganizationRoleTable, err)
+		return nil, &QueryError{Table: OrganizationRoleTable, Op: "executing select query", Err: err}
 	}
 	defer rows.Close()
 
 	var out []OrganizationRole
-	for rows.Next() {
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
 		var r OrganizationRole
 		if err = r.scan(rows); err != nil {
 			return nil, err
@@ -154,35 +272,80 @@ func (q OrgRolesQ) Select(ctx context.Context) ([]OrganizationRole, error) {
 		out = append(out, r)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, &QueryError{Table: OrganizationRoleTable, Op: "iterating rows", Err: err}
 	}
 
 	return out, nil
 }
 
+func (q OrgRolesQ) Each(ctx context.Context, fn func(OrganizationRole) error) error {
+	query, args, err := q.selector.ToSql()
+	if err != nil {
+		return &QueryError{Table: OrganizationRoleTable, Op: "building select query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &QueryError{Table: OrganizationRoleTable, Op: "executing select query", Err: err}
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		var r OrganizationRole
+		if err = r.scan(rows); err != nil {
+			return err
+		}
+		if err = fn(r); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return &QueryError{Table: OrganizationRoleTable, Op: "iterating rows", Err: err}
+	}
+
+	return nil
+}
+
 func (q OrgRolesQ) Delete(ctx context.Context) error {
+	_, err := q.DeleteReturning(ctx)
+	return err
+}
+
+func (q OrgRolesQ) DeleteReturning(ctx context.Context) (int64, error) {
 	query, args, err := q.deleter.ToSql()
 	if err != nil {
-		return fmt.Errorf("building delete query for %s: %w", OrganizationRoleTable, err)
+		return 0, &QueryError{Table: OrganizationRoleTable, Op: "building delete query", Err: err}
 	}
 
-	_, err = q.db.ExecContext(ctx, query, args...)
+	res, err := q.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("executing delete query for %s: %w", OrganizationRoleTable, err)
+		return 0, &QueryError{Table: OrganizationRoleTable, Op: "executing delete query", Err: err}
 	}
 
-	return nil
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationRoleTable, Op: "rows affected", Err: err}
+	}
+
+	return aff, nil
 }
 
 func (q OrgRolesQ) Count(ctx context.Context) (uint, error) {
 	query, args, err := q.counter.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building count query for %s: %w", OrganizationRoleTable, err)
+		return 0, &QueryError{Table: OrganizationRoleTable, Op: "building count query", Err: err}
 	}
 
 	var count uint
 	if err = q.db.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
-		return 0, fmt.Errorf("scanning count for %s: %w", OrganizationRoleTable, err)
+		return 0, &QueryError{Table: OrganizationRoleTable, Op: "scanning count", Err: err}
 	}
 
 	return count, nil
@@ -193,7 +356,7 @@ func (q OrgRolesQ) UpdateOne(ctx context.Context) (OrganizationRole, error) {
 
 	query, args, err := q.updater.Suffix("RETURNING " + OrganizationRoleColumns).ToSql()
 	if err != nil {
-		return OrganizationRole{}, fmt.Errorf("building update query for %s: %w", OrganizationRoleTable, err)
+		return OrganizationRole{}, &QueryError{Table: OrganizationRoleTable, Op: "building update query", Err: err}
 	}
 
 	var updated OrganizationRole
@@ -209,17 +372,17 @@ func (q OrgRolesQ) UpdateMany(ctx context.Context) (int64, error) {
 
 	query, args, err := q.updater.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building update query for %s: %w", OrganizationRoleTable, err)
+		return 0, &QueryError{Table: OrganizationRoleTable, Op: "building update query", Err: err}
 	}
 
 	res, err := q.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return 0, fmt.Errorf("executing update query for %s: %w", OrganizationRoleTable, err)
+		return 0, &QueryError{Table: OrganizationRoleTable, Op: "executing update query", Err: err}
 	}
 
 	aff, err := res.RowsAffected()
 	if err != nil {
-		return 0, fmt.Errorf("rows affected for %s: %w", OrganizationRoleTable, err)
+		return 0, &QueryError{Table: OrganizationRoleTable, Op: "rows affected", Err: err}
 	}
 
 	return aff, nil
@@ -302,6 +465,39 @@ func (q OrgRolesQ) FilterByMemberID(memberID uuid.UUID) OrgRolesQ {
 	return q
 }
 
+func (q OrgRolesQ) FilterByMemberIDs(ids ...uuid.UUID) OrgRolesQ {
+	if len(ids) == 0 {
+		q.selector = q.selector.Where(sq.Expr("1=0"))
+		q.counter = q.counter.Where(sq.Expr("1=0"))
+		q.updater = q.updater.Where(sq.Expr("1=0"))
+		q.deleter = q.deleter.Where(sq.Expr("1=0"))
+		return q
+	}
+
+	sub := sq.
+		Select("DISTINCT mr.role_id").
+		From("organization_member_roles mr").
+		Where(sq.Eq{"mr.member_id": ids})
+
+	subSQL, subArgs, err := sub.ToSql()
+	if err != nil {
+		q.selector = q.selector.Where(sq.Expr("1=0"))
+		q.counter = q.counter.Where(sq.Expr("1=0"))
+		q.updater = q.updater.Where(sq.Expr("1=0"))
+		q.deleter = q.deleter.Where(sq.Expr("1=0"))
+		return q
+	}
+
+	expr := sq.Expr("r.id IN ("+subSQL+")", subArgs...)
+
+	q.selector = q.selector.Where(expr)
+	q.counter = q.counter.Where(expr)
+	q.updater = q.updater.Where(expr)
+	q.deleter = q.deleter.Where(expr)
+
+	return q
+}
+
 func (q OrgRolesQ) FilterHead(head bool) OrgRolesQ {
 	q.selector = q.selector.Where(sq.Eq{"r.head": head})
 	q.counter = q.counter.Where(sq.Eq{"r.head": head})
@@ -318,6 +514,22 @@ func (q OrgRolesQ) FilterByRank(rank int) OrgRolesQ {
 	return q
 }
 
+func (q OrgRolesQ) FilterRankGte(rank uint) OrgRolesQ {
+	q.selector = q.selector.Where(sq.GtOrEq{"r.rank": rank})
+	q.counter = q.counter.Where(sq.GtOrEq{"r.rank": rank})
+	q.updater = q.updater.Where(sq.GtOrEq{"r.rank": rank})
+	q.deleter = q.deleter.Where(sq.GtOrEq{"r.rank": rank})
+	return q
+}
+
+func (q OrgRolesQ) FilterRankLte(rank uint) OrgRolesQ {
+	q.selector = q.selector.Where(sq.LtOrEq{"r.rank": rank})
+	q.counter = q.counter.Where(sq.LtOrEq{"r.rank": rank})
+	q.updater = q.updater.Where(sq.LtOrEq{"r.rank": rank})
+	q.deleter = q.deleter.Where(sq.LtOrEq{"r.rank": rank})
+	return q
+}
+
 func (q OrgRolesQ) FilterLikeName(name string) OrgRolesQ {
 	q.selector = q.selector.Where(sq.ILike{"r.name": "%" + name + "%"})
 	q.counter = q.counter.Where(sq.ILike{"r.name": "%" + name + "%"})
@@ -335,11 +547,43 @@ func (q OrgRolesQ) OrderByRoleRank(asc bool) OrgRolesQ {
 	return q
 }
 
+func (q OrgRolesQ) OrderByName(asc bool) OrgRolesQ {
+	if asc {
+		q.selector = q.selector.OrderBy("r.name ASC", "r.id ASC")
+	} else {
+		q.selector = q.selector.OrderBy("r.name DESC", "r.id DESC")
+	}
+	return q
+}
+
 func (q OrgRolesQ) Page(limit, offset uint) OrgRolesQ {
 	q.selector = q.selector.Limit(uint64(limit)).Offset(uint64(offset))
 	return q
 }
 
+func (q OrgRolesQ) CursorRank(limit uint, asc bool, lastRank uint, lastID uuid.UUID) OrgRolesQ {
+	if asc {
+		q.selector = q.selector.OrderBy("r.rank ASC", "r.id ASC")
+	} else {
+		q.selector = q.selector.OrderBy("r.rank DESC", "r.id DESC")
+	}
+
+	q.selector = q.selector.Limit(uint64(limit))
+
+	// empty cursor means the first page
+	if lastID == uuid.Nil {
+		return q
+	}
+
+	if asc {
+		q.selector = q.selector.Where(sq.Expr("(r.rank, r.id) > (?, ?)", lastRank, lastID))
+	} else {
+		q.selector = q.selector.Where(sq.Expr("(r.rank, r.id) < (?, ?)", lastRank, lastID))
+	}
+
+	return q
+}
+
 //Special methods to interact with role ranks in organization
 
 func (q OrgRolesQ) DeleteAndShiftRanks(ctx context.Context, roleID uuid.UUID) error {
@@ -358,7 +602,7 @@ func (q OrgRolesQ) DeleteAndShiftRanks(ctx context.Context, roleID uuid.UUID) er
 	`
 
 	if _, err := q.db.ExecContext(ctx, sqlq, roleID); err != nil {
-		return fmt.Errorf("executing delete+shift for %s: %w", OrganizationRoleTable, err)
+		return &QueryError{Table: OrganizationRoleTable, Op: "executing delete+shift", Err: err}
 	}
 
 	return nil
@@ -369,9 +613,9 @@ func (q OrgRolesQ) UpdateRoleRank(ctx context.Context, roleID uuid.UUID, newRank
 	var oldRank int
 
 	{
-		const sqlGet = `SELECT organization_id, rank FROM roles WHERE id = $1 LIMIT 1`
+		const sqlGet = `SELECT organization_id, rank FROM ` + OrganizationRoleTable + ` WHERE id = $1 LIMIT 1`
 		if err := q.db.QueryRowContext(ctx, sqlGet, roleID).Scan(&aggID, &oldRank); err != nil {
-			return OrganizationRole{}, fmt.Errorf("scanning role rank: %w", err)
+			return OrganizationRole{}, &QueryError{Table: OrganizationRoleTable, Op: "scanning row", Err: err}
 		}
 	}
 
@@ -434,13 +678,13 @@ func (q OrgRolesQ) UpdateRolesRanks(
 	usedRank := make(map[uint]uuid.UUID, len(order))
 	for roleID, newRank := range order {
 		if newRank < 0 || newRank >= n {
-			return nil, fmt.Errorf("rank %d out of range [0..%d]", newRank, n-1)
+			return nil, fmt.Errorf("%w: rank %d out of range [0..%d]", ErrInvalidRolesRanks, newRank, n-1)
 		}
 		if _, ok := idToRole[roleID]; !ok {
-			return nil, fmt.Errorf("role %s not in organization %s", roleID, organizationID)
+			return nil, fmt.Errorf("%w: role %s not in organization %s", ErrInvalidRolesRanks, roleID, organizationID)
 		}
 		if prev, ok := usedRank[newRank]; ok && prev != roleID {
-			return nil, fmt.Errorf("duplicate rank %d for roles %s and %s", newRank, prev, roleID)
+			return nil, fmt.Errorf("%w: duplicate rank %d for roles %s and %s", ErrInvalidRolesRanks, newRank, prev, roleID)
 		}
 		usedRank[newRank] = roleID
 	}
@@ -505,7 +749,7 @@ func (q OrgRolesQ) UpdateRolesRanks(
 
 	rows, err := q.db.QueryContext(ctx, sqlUpdate, pq.Array(ids), pq.Array(newRanks), organizationID)
 	if err != nil {
-		return nil, fmt.Errorf("updating roles ranks: %w", err)
+		return nil, &QueryError{Table: OrganizationRoleTable, Op: "executing update ranks query", Err: err}
 	}
 	defer rows.Close()
 
@@ -518,8 +762,112 @@ func (q OrgRolesQ) UpdateRolesRanks(
 		out = append(out, r)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, &QueryError{Table: OrganizationRoleTable, Op: "iterating rows", Err: err}
 	}
 
 	return out, nil
 }
+
+func (q OrgRolesQ) SwapRanks(
+	ctx context.Context,
+	organizationID uuid.UUID,
+	roleA, roleB uuid.UUID,
+) ([]OrganizationRole, error) {
+	if roleA == roleB {
+		return nil, fmt.Errorf("cannot swap role %s with itself", roleA)
+	}
+
+	// Each row takes the rank of the other one, so nothing is updated
+	// unless both roles belong to the organization.
+	const sqlSwap = `
+		UPDATE organization_roles r
+		SET
+			rank = o.rank,
+			updated_at = now()
+		FROM organization_roles o
+		WHERE r.organization_id = $1
+		  AND o.organization_id = $1
+		  AND ((r.id = $2 AND o.id = $3) OR (r.id = $3 AND o.id = $2))
+		RETURNING r.id, r.organization_id, r.head, r.rank, r.name, r.color, r.created_at, r.updated_at
+	`
+
+	rows, err := q.db.QueryContext(ctx, sqlSwap, organizationID, roleA, roleB)
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationRoleTable, Op: "executing swap ranks query", Err: err}
+	}
+	defer rows.Close()
+
+	out := make([]OrganizationRole, 0, 2)
+	for rows.Next() {
+		var r OrganizationRole
+		if err = r.scan(rows); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &QueryError{Table: OrganizationRoleTable, Op: "iterating rows", Err: err}
+	}
+
+	if len(out) != 2 {
+		return nil, fmt.Errorf("roles %s and %s not both in organization %s", roleA, roleB, organizationID)
+	}
+
+	return out, nil
+}
+
+func (q OrgRolesQ) DeleteManyAndRepairRanks(ctx context.Context, organizationID uuid.UUID, roleIDs []uuid.UUID) error {
+	if len(roleIDs) == 0 {
+		return nil
+	}
+
+	unique := make(map[uuid.UUID]struct{}, len(roleIDs))
+	ids := make([]string, 0, len(roleIDs))
+	for _, id := range roleIDs {
+		if _, ok := unique[id]; ok {
+			continue
+		}
+		unique[id] = struct{}{}
+		ids = append(ids, id.String())
+	}
+
+	count, err := NewOrgRolesQ(q.db).
+		FilterByOrganizationID(organizationID).
+		FilterByID(roleIDs...).
+		Count(ctx)
+	if err != nil {
+		return fmt.Errorf("count roles by organization: %w", err)
+	}
+	if count != uint(len(unique)) {
+		return fmt.Errorf("not all roles belong to organization %s", organizationID)
+	}
+
+	// Deleting and renumbering in one statement keeps the ranks contiguous
+	// even if the caller is not inside a transaction.
+	const sqlq = `
+		WITH del AS (
+			DELETE FROM organization_roles
+			WHERE organization_id = $1
+			  AND id = ANY($2::uuid[])
+		),
+		ranked AS (
+			SELECT id, (ROW_NUMBER() OVER (ORDER BY rank, id) - 1)::int AS rank
+			FROM organization_roles
+			WHERE organization_id = $1
+			  AND NOT (id = ANY($2::uuid[]))
+		)
+		UPDATE organization_roles r
+		SET
+			rank = ranked.rank,
+			updated_at = now()
+		FROM ranked
+		WHERE r.id = ranked.id
+		  AND r.rank <> ranked.rank
+	`
+
+	if _, err = q.db.ExecContext(ctx, sqlq, organizationID, pq.Array(ids)); err != nil {
+		return &QueryError{Table: OrganizationRoleTable, Op: "executing delete+repair", Err: err}
+	}
+
+	return nil
+}
@@ -4,10 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/netbill/pgx"
 )
 
@@ -51,11 +51,11 @@ func (q OrgRolePermissionLinksQ) Insert(ctx context.Context, data ...Organizatio
 
 	query, args, err := ins.ToSql()
 	if err != nil {
-		return fmt.Errorf("building insert query for %s: %w", OrganizationRolePermissionsTable, err)
+		return &QueryError{Table: OrganizationRolePermissionsTable, Op: "building insert query", Err: err}
 	}
 
 	if _, err := q.db.ExecContext(ctx, query, args...); err != nil {
-		return fmt.Errorf("executing insert query for %s: %w", OrganizationRolePermissionsTable, err)
+		return &QueryError{Table: OrganizationRolePermissionsTable, Op: "executing insert query", Err: err}
 	}
 
 	return nil
@@ -64,16 +64,16 @@ func (q OrgRolePermissionLinksQ) Insert(ctx context.Context, data ...Organizatio
 func (q OrgRolePermissionLinksQ) Get(ctx context.Context) (OrganizationRolePermissionLink, error) {
 	query, args, err := q.selector.ToSql()
 	if err != nil {
-		return OrganizationRolePermissionLink{}, fmt.Errorf("building select query for %s: %w", OrganizationRolePermissionsTable, err)
+		return OrganizationRolePermissionLink{}, &QueryError{Table: OrganizationRolePermissionsTable, Op: "building select query", Err: err}
 	}
 
 	var rp OrganizationRolePermissionLink
 	if err = q.db.QueryRowContext(ctx, query, args...).Scan(&rp.RoleID, &rp.PermissionID); err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return OrganizationRolePermissionLink{}, nil
+			return OrganizationRolePermissionLink{}, &QueryError{Table: OrganizationRolePermissionsTable, Op: "getting row", Err: ErrNotFound}
 		default:
-			return OrganizationRolePermissionLink{}, fmt.Errorf("scanning row for %s: %w", OrganizationRolePermissionsTable, err)
+			return OrganizationRolePermissionLink{}, &QueryError{Table: OrganizationRolePermissionsTable, Op: "scanning row", Err: err}
 		}
 	}
 
@@ -83,43 +83,94 @@ func (q OrgRolePermissionLinksQ) Get(ctx context.Context) (OrganizationRolePermi
 func (q OrgRolePermissionLinksQ) Select(ctx context.Context) ([]OrganizationRolePermissionLink, error) {
 	query, args, err := q.selector.ToSql()
 	if err != nil {
-		return nil, fmt.Errorf("building select query for %s: %w", OrganizationRolePermissionsTable, err)
+		return nil, &QueryError{Table: OrganizationRolePermissionsTable, Op: "building select query", Err: err}
 	}
 
 	rows, err := q.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("executing select query for %s: %w", OrganizationRolePermissionsTable, err)
+		return nil, &QueryError{Table: OrganizationRolePermissionsTable, Op: "executing select query", Err: err}
 	}
 	defer rows.Close()
 
 	var rps []OrganizationRolePermissionLink
-	for rows.Next() {
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
 		var rp OrganizationRolePermissionLink
 		if err = rows.Scan(&rp.RoleID, &rp.PermissionID); err != nil {
-			return nil, fmt.Errorf("scanning row for %s: %w", OrganizationRolePermissionsTable, err)
+			return nil, &QueryError{Table: OrganizationRolePermissionsTable, Op: "scanning row", Err: err}
 		}
 		rps = append(rps, rp)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterating rows for %s: %w", OrganizationRolePermissionsTable, err)
+		return nil, &QueryError{Table: OrganizationRolePermissionsTable, Op: "iterating rows", Err: err}
 	}
 
 	return rps, nil
 }
 
+func (q OrgRolePermissionLinksQ) Each(ctx context.Context, fn func(OrganizationRolePermissionLink) error) error {
+	query, args, err := q.selector.ToSql()
+	if err != nil {
+		return &QueryError{Table: OrganizationRolePermissionsTable, Op: "building select query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &QueryError{Table: OrganizationRolePermissionsTable, Op: "executing select query", Err: err}
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		var rp OrganizationRolePermissionLink
+		if err = rows.Scan(&rp.RoleID, &rp.PermissionID); err != nil {
+			return &QueryError{Table: OrganizationRolePermissionsTable, Op: "scanning row", Err: err}
+		}
+		if err = fn(rp); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return &QueryError{Table: OrganizationRolePermissionsTable, Op: "iterating rows", Err: err}
+	}
+
+	return nil
+}
+
 func (q OrgRolePermissionLinksQ) Delete(ctx context.Context) error {
+	_, err := q.DeleteReturning(ctx)
+	return err
+}
+
+func (q OrgRolePermissionLinksQ) DeleteReturning(ctx context.Context) (int64, error) {
 	query, args, err := q.deleter.ToSql()
 	if err != nil {
-		return fmt.Errorf("building delete query for %s: %w", OrganizationRolePermissionsTable, err)
+		return 0, &QueryError{Table: OrganizationRolePermissionsTable, Op: "building delete query", Err: err}
 	}
 
-	_, err = q.db.ExecContext(ctx, query, args...)
+	res, err := q.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("executing delete query for %s: %w", OrganizationRolePermissionsTable, err)
+		return 0, &QueryError{Table: OrganizationRolePermissionsTable, Op: "executing delete query", Err: err}
 	}
 
-	return nil
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationRolePermissionsTable, Op: "rows affected", Err: err}
+	}
+
+	return n, nil
 }
 
 func (q OrgRolePermissionLinksQ) FilterByRoleID(roleID uuid.UUID) OrgRolePermissionLinksQ {
@@ -184,7 +235,7 @@ func (q OrgRolePermissionLinksQ) FilterByAccountID(accountID uuid.UUID) OrgRoleP
 func (q OrgRolePermissionLinksQ) FilterByOrganizationID(organizationID uuid.UUID) OrgRolePermissionLinksQ {
 	sub := sq.
 		Select("id").
-		From("roles").
+		From(OrganizationRoleTable).
 		Where(sq.Eq{"organization_id": organizationID})
 
 	subSQL, subArgs, err := sub.ToSql()
@@ -228,12 +279,12 @@ func (q OrgRolePermissionLinksQ) FilterByMemberID(memberID uuid.UUID) OrgRolePer
 func (q OrgRolePermissionLinksQ) Count(ctx context.Context) (uint, error) {
 	query, args, err := q.counter.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building count query for %s: %w", OrganizationRolePermissionsTable, err)
+		return 0, &QueryError{Table: OrganizationRolePermissionsTable, Op: "building count query", Err: err}
 	}
 
 	var n uint
 	if err = q.db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
-		return 0, fmt.Errorf("scanning count for %s: %w", OrganizationRolePermissionsTable, err)
+		return 0, &QueryError{Table: OrganizationRolePermissionsTable, Op: "scanning count", Err: err}
 	}
 	return n, nil
 }
@@ -246,14 +297,81 @@ func (q OrgRolePermissionLinksQ) Page(limit, offset uint) OrgRolePermissionLinks
 func (q OrgRolePermissionLinksQ) Exists(ctx context.Context) (bool, error) {
 	subSQL, subArgs, err := q.selector.Limit(1).ToSql()
 	if err != nil {
-		return false, fmt.Errorf("building exists query for %s: %w", OrganizationRolePermissionsTable, err)
+		return false, &QueryError{Table: OrganizationRolePermissionsTable, Op: "building exists query", Err: err}
 	}
 
 	sqlq := "SELECT EXISTS (" + subSQL + ")"
 
 	var ok bool
 	if err = q.db.QueryRowContext(ctx, sqlq, subArgs...).Scan(&ok); err != nil {
-		return false, fmt.Errorf("scanning exists for %s: %w", OrganizationRolePermissionsTable, err)
+		return false, &QueryError{Table: OrganizationRolePermissionsTable, Op: "scanning exists", Err: err}
 	}
 	return ok, nil
 }
+
+func (q OrgRolePermissionLinksQ) ReplacePermissionsForRole(
+	ctx context.Context,
+	roleID uuid.UUID,
+	permissionIDs []uuid.UUID,
+) error {
+	_, _, err := q.SyncPermissions(ctx, roleID, permissionIDs)
+	return err
+}
+
+func (q OrgRolePermissionLinksQ) SyncPermissions(
+	ctx context.Context,
+	roleID uuid.UUID,
+	desired []uuid.UUID,
+) (added, removed []uuid.UUID, err error) {
+	sqlq := `
+		WITH desired AS (
+			SELECT DISTINCT UNNEST($2::uuid[]) AS permission_id
+		),
+		del AS (
+			DELETE FROM ` + OrganizationRolePermissionsTable + `
+			WHERE role_id = $1
+			  AND permission_id NOT IN (SELECT permission_id FROM desired)
+			RETURNING permission_id
+		),
+		ins AS (
+			INSERT INTO ` + OrganizationRolePermissionsTable + ` (role_id, permission_id)
+			SELECT $1, permission_id FROM desired
+			ON CONFLICT DO NOTHING
+			RETURNING permission_id
+		)
+		SELECT true AS added, permission_id FROM ins
+		UNION ALL
+		SELECT false AS added, permission_id FROM del
+	`
+
+	ids := make([]string, len(desired))
+	for i, id := range desired {
+		ids[i] = id.String()
+	}
+
+	rows, err := q.db.QueryContext(ctx, sqlq, roleID, pq.Array(ids))
+	if err != nil {
+		return nil, nil, &QueryError{Table: OrganizationRolePermissionsTable, Op: "syncing permissions for role", Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var isAdded bool
+		var permissionID uuid.UUID
+		if err = rows.Scan(&isAdded, &permissionID); err != nil {
+			return nil, nil, &QueryError{Table: OrganizationRolePermissionsTable, Op: "scanning row", Err: err}
+		}
+
+		if isAdded {
+			added = append(added, permissionID)
+		} else {
+			removed = append(removed, permissionID)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, &QueryError{Table: OrganizationRolePermissionsTable, Op: "iterating rows", Err: err}
+	}
+
+	return added, removed, nil
+}
@@ -0,0 +1,49 @@
+package pgdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestOrgRolePermissionLinksQFilterByOrganizationID(t *testing.T) {
+	orgA := uuid.New()
+	orgB := uuid.New()
+
+	conn := &stubConn{
+		columns: []string{"role_id", "permission_id"},
+		rows: [][]driver.Value{
+			{uuid.NewString(), uuid.NewString()},
+		},
+	}
+
+	links, err := NewOrgRolePermissionsQ(newStubDB(t, conn)).
+		FilterByOrganizationID(orgA).
+		Select(context.Background())
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	if len(links) != 1 {
+		t.Fatalf("Select returned %d links, want 1", len(links))
+	}
+
+	wantSub := "role_id IN (SELECT id FROM " + OrganizationRoleTable + " WHERE organization_id = $1)"
+	if !strings.Contains(conn.query, wantSub) {
+		t.Errorf("query %q does not contain %q", conn.query, wantSub)
+	}
+
+	if len(conn.args) != 1 || conn.args[0].Value != orgA.String() {
+		t.Errorf("args = %v, want exactly [%s]", conn.args, orgA)
+	}
+	for _, arg := range conn.args {
+		if arg.Value == orgB.String() {
+			t.Errorf("args %v contain organization %s", conn.args, orgB)
+		}
+	}
+	if strings.Contains(conn.query, orgB.String()) {
+		t.Errorf("query %q contains organization %s", conn.query, orgB)
+	}
+}
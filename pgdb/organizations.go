@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,30 +13,41 @@ import (
 )
 
 const OrganizationTable = "organizations"
-const OrganizationColumns = "id, status, name, icon, created_at, updated_at"
+const OrganizationColumns = "id, status, status_changed_at, name, icon, created_at, updated_at, deleted_at"
 
-type Organization struct {
-	ID       uuid.UUID `json:"id"`
-	Status   string    `json:"status"`
-	Verified bool      `json:"verified"`
-	Name     string    `json:"name"`
-	Icon     *string   `json:"icon"`
+// Organization statuses as stored in organization_status.
+const (
+	OrgStatusActive    = "active"
+	OrgStatusInactive  = "inactive"
+	OrgStatusSuspended = "suspended"
+)
 
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+type Organization struct {
+	ID              uuid.UUID `json:"id"`
+	Status          string    `json:"status"`
+	StatusChangedAt time.Time `json:"status_changed_at"`
+	Verified        bool      `json:"verified"`
+	Name            string    `json:"name"`
+	Icon            *string   `json:"icon"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 func (a *Organization) scan(row sq.RowScanner) error {
 	err := row.Scan(
 		&a.ID,
 		&a.Status,
+		&a.StatusChangedAt,
 		&a.Name,
 		&a.Icon,
 		&a.CreatedAt,
 		&a.UpdatedAt,
+		&a.DeletedAt,
 	)
 	if err != nil {
-		return fmt.Errorf("scanning organization: %w", err)
+		return &QueryError{Table: OrganizationTable, Op: "scanning row", Err: err}
 	}
 	return nil
 }
@@ -74,7 +84,7 @@ func (q OrganizationsQ) Insert(ctx context.Context, data OrganizationsQInsertInp
 		"icon": data.Icon,
 	}).Suffix("RETURNING " + OrganizationColumns).ToSql()
 	if err != nil {
-		return Organization{}, fmt.Errorf("building insert query for %s: %w", OrganizationTable, err)
+		return Organization{}, &QueryError{Table: OrganizationTable, Op: "building insert query", Err: err}
 	}
 
 	var inserted Organization
@@ -91,6 +101,88 @@ func (q OrganizationsQ) Insert(ctx context.Context, data OrganizationsQInsertInp
 	return inserted, nil
 }
 
+type OrganizationsQUpsertInput struct {
+	ID     uuid.UUID
+	Status string
+	Name   string
+	Icon   *string
+}
+
+func (q OrganizationsQ) Upsert(ctx context.Context, data OrganizationsQUpsertInput) (Organization, error) {
+	query, args, err := q.inserter.
+		SetMap(map[string]interface{}{
+			"id":     data.ID,
+			"status": data.Status,
+			"name":   data.Name,
+			"icon":   data.Icon,
+		}).
+		Suffix(`
+			ON CONFLICT (id) DO UPDATE SET
+				status_changed_at = CASE
+					WHEN organizations.status <> EXCLUDED.status THEN now()
+					ELSE organizations.status_changed_at
+				END,
+				status = EXCLUDED.status,
+				name   = EXCLUDED.name,
+				icon   = EXCLUDED.icon,
+				updated_at = now()
+			RETURNING ` + OrganizationColumns,
+		).
+		ToSql()
+	if err != nil {
+		return Organization{}, &QueryError{Table: OrganizationTable, Op: "building upsert query", Err: err}
+	}
+
+	var result Organization
+	if err = result.scan(q.db.QueryRowContext(ctx, query, args...)); err != nil {
+		return Organization{}, err
+	}
+
+	return result, nil
+}
+
+func (q OrganizationsQ) InsertBatch(ctx context.Context, data []OrganizationsQInsertInput) ([]Organization, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	out := make([]Organization, 0, len(data))
+	for start := 0; start < len(data); start += insertBatchSize {
+		end := min(start+insertBatchSize, len(data))
+
+		ins := q.inserter.Columns("name", "icon")
+		for _, d := range data[start:end] {
+			ins = ins.Values(d.Name, d.Icon)
+		}
+
+		query, args, err := ins.Suffix("RETURNING " + OrganizationColumns).ToSql()
+		if err != nil {
+			return nil, &QueryError{Table: OrganizationTable, Op: "building insert query", Err: err}
+		}
+
+		rows, err := q.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, &QueryError{Table: OrganizationTable, Op: "executing insert query", Err: err}
+		}
+
+		for rows.Next() {
+			var organization Organization
+			if err = organization.scan(rows); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out = append(out, organization)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, &QueryError{Table: OrganizationTable, Op: "iterating rows", Err: err}
+		}
+	}
+
+	return out, nil
+}
+
 func (q OrganizationsQ) FilterByID(id uuid.UUID) OrganizationsQ {
 	q.selector = q.selector.Where(sq.Eq{"id": id})
 	q.counter = q.counter.Where(sq.Eq{"id": id})
@@ -99,6 +191,22 @@ func (q OrganizationsQ) FilterByID(id uuid.UUID) OrganizationsQ {
 	return q
 }
 
+func (q OrganizationsQ) FilterByIDs(ids ...uuid.UUID) OrganizationsQ {
+	if len(ids) == 0 {
+		q.selector = q.selector.Where(sq.Expr("1=0"))
+		q.counter = q.counter.Where(sq.Expr("1=0"))
+		q.updater = q.updater.Where(sq.Expr("1=0"))
+		q.deleter = q.deleter.Where(sq.Expr("1=0"))
+		return q
+	}
+
+	q.selector = q.selector.Where(sq.Eq{"id": ids})
+	q.counter = q.counter.Where(sq.Eq{"id": ids})
+	q.updater = q.updater.Where(sq.Eq{"id": ids})
+	q.deleter = q.deleter.Where(sq.Eq{"id": ids})
+	return q
+}
+
 func (q OrganizationsQ) FilterByStatus(status string) OrganizationsQ {
 	q.selector = q.selector.Where(sq.Eq{"status": status})
 	q.counter = q.counter.Where(sq.Eq{"status": status})
@@ -132,12 +240,26 @@ func (q OrganizationsQ) FilterByAccountID(accountID uuid.UUID) OrganizationsQ {
 	return q
 }
 
+func (q OrganizationsQ) FilterNotDeleted() OrganizationsQ {
+	q.selector = q.selector.Where(sq.Eq{"deleted_at": nil})
+	q.counter = q.counter.Where(sq.Eq{"deleted_at": nil})
+	q.updater = q.updater.Where(sq.Eq{"deleted_at": nil})
+	q.deleter = q.deleter.Where(sq.Eq{"deleted_at": nil})
+	return q
+}
+
 func (q OrganizationsQ) FilterNameLike(name string) OrganizationsQ {
 	q.selector = q.selector.Where(sq.Like{"name": "%" + name + "%"})
 	q.counter = q.counter.Where(sq.Like{"name": "%" + name + "%"})
 	return q
 }
 
+func (q OrganizationsQ) FilterNameILike(name string) OrganizationsQ {
+	q.selector = q.selector.Where(sq.ILike{"name": "%" + name + "%"})
+	q.counter = q.counter.Where(sq.ILike{"name": "%" + name + "%"})
+	return q
+}
+
 func (q OrganizationsQ) OrderName(asc bool) OrganizationsQ {
 	if asc {
 		q.selector = q.selector.OrderBy("name ASC", "id ASC")
@@ -147,37 +269,101 @@ func (q OrganizationsQ) OrderName(asc bool) OrganizationsQ {
 	return q
 }
 
+func (q OrganizationsQ) Exists(ctx context.Context) (bool, error) {
+	existsQ := q.selector.
+		Columns("1").
+		RemoveLimit().
+		RemoveOffset().
+		Prefix("SELECT EXISTS (").
+		Suffix(") AS exists").
+		Limit(1)
+
+	query, args, err := existsQ.ToSql()
+	if err != nil {
+		return false, &QueryError{Table: OrganizationTable, Op: "building exists query", Err: err}
+	}
+
+	var ok bool
+	if err = q.db.QueryRowContext(ctx, query, args...).Scan(&ok); err != nil {
+		return false, &QueryError{Table: OrganizationTable, Op: "scanning exists", Err: err}
+	}
+
+	return ok, nil
+}
+
+func (q OrganizationsQ) OrderByCreatedAt(asc bool) OrganizationsQ {
+	if asc {
+		q.selector = q.selector.OrderBy("created_at ASC", "id ASC")
+	} else {
+		q.selector = q.selector.OrderBy("created_at DESC", "id DESC")
+	}
+	return q
+}
+
+func (q OrganizationsQ) CursorCreatedAt(limit uint, asc bool, createdAt time.Time, id uuid.UUID) OrganizationsQ {
+	q = q.OrderByCreatedAt(asc)
+	q.selector = q.selector.Limit(uint64(limit))
+
+	// empty cursor means the first page
+	if id == uuid.Nil {
+		return q
+	}
+
+	if asc {
+		q.selector = q.selector.Where(sq.Expr("(created_at, id) > (?, ?)", createdAt, id))
+	} else {
+		q.selector = q.selector.Where(sq.Expr("(created_at, id) < (?, ?)", createdAt, id))
+	}
+
+	return q
+}
+
 func (q OrganizationsQ) Get(ctx context.Context) (Organization, error) {
 	query, args, err := q.selector.Limit(1).ToSql()
 	if err != nil {
-		return Organization{}, fmt.Errorf("building select query for %s: %w", OrganizationTable, err)
+		return Organization{}, &QueryError{Table: OrganizationTable, Op: "building select query", Err: err}
 	}
 
 	row := q.db.QueryRowContext(ctx, query, args...)
 
 	var a Organization
 	if err = a.scan(row); err != nil {
-		return Organization{}, err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return Organization{}, &QueryError{Table: OrganizationTable, Op: "getting row", Err: ErrNotFound}
+		default:
+			return Organization{}, err
+		}
 	}
 
 	return a, nil
 
 }
 
+func (q OrganizationsQ) GetByID(ctx context.Context, id uuid.UUID) (Organization, error) {
+	return q.FilterByID(id).Get(ctx)
+}
+
 func (q OrganizationsQ) Select(ctx context.Context) ([]Organization, error) {
 	query, args, err := q.selector.ToSql()
 	if err != nil {
-		return nil, fmt.Errorf("building select query for %s: %w", OrganizationTable, err)
+		return nil, &QueryError{Table: OrganizationTable, Op: "building select query", Err: err}
 	}
 
 	rows, err := q.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("executing select query for %s: %w", OrganizationTable, err)
+		return nil, &QueryError{Table: OrganizationTable, Op: "executing select query", Err: err}
 	}
 	defer rows.Close()
 
 	var organizations []Organization
-	for rows.Next() {
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
 		var organization Organization
 		err = organization.scan(rows)
 		if err != nil {
@@ -186,12 +372,100 @@ func (q OrganizationsQ) Select(ctx context.Context) ([]Organization, error) {
 		organizations = append(organizations, organization)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, &QueryError{Table: OrganizationTable, Op: "iterating rows", Err: err}
 	}
 
 	return organizations, nil
 }
 
+func (q OrganizationsQ) Each(ctx context.Context, fn func(Organization) error) error {
+	query, args, err := q.selector.ToSql()
+	if err != nil {
+		return &QueryError{Table: OrganizationTable, Op: "building select query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &QueryError{Table: OrganizationTable, Op: "executing select query", Err: err}
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		var organization Organization
+		if err = organization.scan(rows); err != nil {
+			return err
+		}
+		if err = fn(organization); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return &QueryError{Table: OrganizationTable, Op: "iterating rows", Err: err}
+	}
+
+	return nil
+}
+
+type OrganizationWithMemberCount struct {
+	Organization
+	MemberCount uint `json:"member_count"`
+}
+
+func (q OrganizationsQ) SelectWithMemberCount(ctx context.Context) ([]OrganizationWithMemberCount, error) {
+	// The selector reads organizations without an alias, so the count is taken
+	// with a correlated subquery to keep existing filters unambiguous.
+	query, args, err := q.selector.
+		Column("(SELECT COUNT(m.id) FROM " + OrganizationMembersTable + " m WHERE m.organization_id = " + OrganizationTable + ".id) AS member_count").
+		ToSql()
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationTable, Op: "building select with member count query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationTable, Op: "executing select with member count query", Err: err}
+	}
+	defer rows.Close()
+
+	var out []OrganizationWithMemberCount
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		var o OrganizationWithMemberCount
+		err = rows.Scan(
+			&o.ID,
+			&o.Status,
+			&o.StatusChangedAt,
+			&o.Name,
+			&o.Icon,
+			&o.CreatedAt,
+			&o.UpdatedAt,
+			&o.DeletedAt,
+			&o.MemberCount,
+		)
+		if err != nil {
+			return nil, &QueryError{Table: OrganizationTable, Op: "scanning row", Err: err}
+		}
+		out = append(out, o)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &QueryError{Table: OrganizationTable, Op: "iterating rows", Err: err}
+	}
+
+	return out, nil
+}
+
 func (q OrganizationsQ) UpdateOne(ctx context.Context) (Organization, error) {
 	q.updater = q.updater.Set("updated_at", time.Now().UTC())
 
@@ -199,7 +473,7 @@ func (q OrganizationsQ) UpdateOne(ctx context.Context) (Organization, error) {
 		Suffix("RETURNING " + OrganizationColumns).
 		ToSql()
 	if err != nil {
-		return Organization{}, fmt.Errorf("building update query for %s: %w", OrganizationTable, err)
+		return Organization{}, &QueryError{Table: OrganizationTable, Op: "building update query", Err: err}
 	}
 
 	var updated Organization
@@ -215,17 +489,17 @@ func (q OrganizationsQ) UpdateMany(ctx context.Context) (int64, error) {
 
 	query, args, err := q.updater.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building update query for %s: %w", OrganizationTable, err)
+		return 0, &QueryError{Table: OrganizationTable, Op: "building update query", Err: err}
 	}
 
 	res, err := q.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return 0, fmt.Errorf("executing update query for %s: %w", OrganizationTable, err)
+		return 0, &QueryError{Table: OrganizationTable, Op: "executing update query", Err: err}
 	}
 
 	affected, err := res.RowsAffected()
 	if err != nil {
-		return 0, fmt.Errorf("rows affected for %s: %w", OrganizationTable, err)
+		return 0, &QueryError{Table: OrganizationTable, Op: "rows affected", Err: err}
 	}
 
 	return affected, nil
@@ -241,23 +515,66 @@ func (q OrganizationsQ) UpdateIcon(icon string) OrganizationsQ {
 	return q
 }
 
+func (q OrganizationsQ) UpdateIconPtr(icon *string) OrganizationsQ {
+	q.updater = q.updater.Set("icon", icon)
+	return q
+}
+
 func (q OrganizationsQ) UpdateStatus(status string) OrganizationsQ {
-	q.updater = q.updater.Set("status", status)
+	q.updater = q.updater.
+		Set("status", status).
+		Set("status_changed_at", sq.Expr("CASE WHEN status <> ? THEN now() ELSE status_changed_at END", status))
 	return q
 }
 
 func (q OrganizationsQ) Delete(ctx context.Context) error {
+	_, err := q.DeleteReturning(ctx)
+	return err
+}
+
+func (q OrganizationsQ) DeleteReturning(ctx context.Context) (int64, error) {
 	query, args, err := q.deleter.ToSql()
 	if err != nil {
-		return fmt.Errorf("building delete query for %s: %w", OrganizationTable, err)
+		return 0, &QueryError{Table: OrganizationTable, Op: "building delete query", Err: err}
 	}
 
-	_, err = q.db.ExecContext(ctx, query, args...)
+	res, err := q.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("executing delete query for %s: %w", OrganizationTable, err)
+		return 0, &QueryError{Table: OrganizationTable, Op: "executing delete query", Err: err}
 	}
 
-	return nil
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationTable, Op: "rows affected", Err: err}
+	}
+
+	return affected, nil
+}
+
+// SoftDelete stamps deleted_at on matching rows that are not deleted yet, so a replayed delete affects no rows.
+func (q OrganizationsQ) SoftDelete(ctx context.Context) (int64, error) {
+	now := time.Now().UTC()
+
+	query, args, err := q.updater.
+		Set("deleted_at", now).
+		Set("updated_at", now).
+		Where(sq.Eq{"deleted_at": nil}).
+		ToSql()
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationTable, Op: "building soft delete query", Err: err}
+	}
+
+	res, err := q.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationTable, Op: "executing soft delete query", Err: err}
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, &QueryError{Table: OrganizationTable, Op: "rows affected", Err: err}
+	}
+
+	return affected, nil
 }
 
 func (q OrganizationsQ) Page(limit, offset uint) OrganizationsQ {
@@ -268,7 +585,7 @@ func (q OrganizationsQ) Page(limit, offset uint) OrganizationsQ {
 func (q OrganizationsQ) Count(ctx context.Context) (uint, error) {
 	query, args, err := q.counter.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building count query for %s: %w", OrganizationTable, err)
+		return 0, &QueryError{Table: OrganizationTable, Op: "building count query", Err: err}
 	}
 
 	row := q.db.QueryRowContext(ctx, query, args...)
@@ -276,8 +593,36 @@ func (q OrganizationsQ) Count(ctx context.Context) (uint, error) {
 	var count uint
 	err = row.Scan(&count)
 	if err != nil {
-		return 0, fmt.Errorf("scanning count for %s: %w", OrganizationTable, err)
+		return 0, &QueryError{Table: OrganizationTable, Op: "scanning count", Err: err}
 	}
 
 	return count, nil
 }
+
+func (q OrganizationsQ) CountByStatus(ctx context.Context) (map[string]uint, error) {
+	query, args, err := q.counter.Columns("status").GroupBy("status").ToSql()
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationTable, Op: "building count by status query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &QueryError{Table: OrganizationTable, Op: "executing count by status query", Err: err}
+	}
+	defer rows.Close()
+
+	out := make(map[string]uint)
+	for rows.Next() {
+		var status string
+		var count uint
+		if err = rows.Scan(&count, &status); err != nil {
+			return nil, &QueryError{Table: OrganizationTable, Op: "scanning count by status", Err: err}
+		}
+		out[status] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &QueryError{Table: OrganizationTable, Op: "iterating rows", Err: err}
+	}
+
+	return out, nil
+}
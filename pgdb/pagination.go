@@ -0,0 +1,32 @@
+package pgdb
+
+import (
+	"context"
+	"fmt"
+)
+
+type Pagination[T any] struct {
+	Items []T  `json:"items"`
+	Total uint `json:"total"`
+}
+
+type pageable[T any] interface {
+	Select(ctx context.Context) ([]T, error)
+	Count(ctx context.Context) (uint, error)
+}
+
+// Paginate runs Select and Count for the same query. Count ignores Page and
+// cursor limits, so Total is the number of rows matching the filters.
+func Paginate[T any](ctx context.Context, q pageable[T]) (Pagination[T], error) {
+	items, err := q.Select(ctx)
+	if err != nil {
+		return Pagination[T]{}, fmt.Errorf("selecting page items: %w", err)
+	}
+
+	total, err := q.Count(ctx)
+	if err != nil {
+		return Pagination[T]{}, fmt.Errorf("counting page total: %w", err)
+	}
+
+	return Pagination[T]{Items: items, Total: total}, nil
+}
@@ -0,0 +1,9 @@
+package pgdb
+
+// selectCtxCheckInterval is how many rows Select and Each loops scan between context checks,
+// so a cancelled context stops long scans without paying for a check on every row.
+const selectCtxCheckInterval = 256
+
+// insertBatchSize caps the number of rows per multi-row INSERT so a batch
+// stays well below the Postgres limit of 65535 bind parameters.
+const insertBatchSize = 1000
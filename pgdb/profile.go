@@ -4,18 +4,18 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/netbill/pgx"
 )
 
 const ProfileTable = "profiles"
 
-const ProfileColumns = "account_id, username, official, pseudonym, updated_at, created_at"
-const ProfileColumnsP = "p.account_id, p.username, p.official, p.pseudonym, p.updated_at, p.created_at"
+const ProfileColumns = "account_id, username, official, pseudonym, created_at, updated_at"
+const ProfileColumnsP = "p.account_id, p.username, p.official, p.pseudonym, p.created_at, p.updated_at"
 
 type Profile struct {
 	AccountID uuid.UUID `json:"account_id"`
@@ -37,7 +37,7 @@ func (p *Profile) scan(row sq.RowScanner) error {
 		&p.UpdatedAt,
 	)
 	if err != nil {
-		return fmt.Errorf("scanning profile: %w", err)
+		return &QueryError{Table: ProfileTable, Op: "scanning row", Err: err}
 	}
 	return nil
 }
@@ -78,7 +78,7 @@ func (q ProfilesQ) Insert(ctx context.Context, data ProfileInsertInput) (Profile
 		"pseudonym":  data.Pseudonym,
 	}).Suffix("RETURNING " + ProfileColumns).ToSql()
 	if err != nil {
-		return Profile{}, fmt.Errorf("building insert query for %s: %w", ProfileTable, err)
+		return Profile{}, &QueryError{Table: ProfileTable, Op: "building insert query", Err: err}
 	}
 
 	var inserted Profile
@@ -88,33 +88,90 @@ func (q ProfilesQ) Insert(ctx context.Context, data ProfileInsertInput) (Profile
 	return inserted, nil
 }
 
+// CopyFrom bulk loads profiles with COPY and returns the number of rows loaded.
+// COPY has no ON CONFLICT, so it is meant for populating an empty replica; q.db must be a transaction.
+func (q ProfilesQ) CopyFrom(ctx context.Context, data []ProfileInsertInput) (int64, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	stmt, err := q.db.PrepareContext(ctx, pq.CopyIn(ProfileTable, "account_id", "username", "official", "pseudonym"))
+	if err != nil {
+		return 0, &QueryError{Table: ProfileTable, Op: "preparing copy", Err: err}
+	}
+	defer stmt.Close()
+
+	for _, d := range data {
+		if _, err = stmt.ExecContext(ctx, d.AccountID, d.Username, d.Official, d.Pseudonym); err != nil {
+			return 0, &QueryError{Table: ProfileTable, Op: "copying row", Err: err}
+		}
+	}
+
+	res, err := stmt.ExecContext(ctx)
+	if err != nil {
+		return 0, &QueryError{Table: ProfileTable, Op: "executing copy", Err: err}
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, &QueryError{Table: ProfileTable, Op: "rows affected", Err: err}
+	}
+	return n, nil
+}
+
 type ProfileUpsertInput struct {
 	AccountID uuid.UUID
 	Username  string
 	Official  bool
 	Pseudonym *string
+
+	// Source timestamps; zero values fall back to the current time.
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
+func (d ProfileUpsertInput) timestamps() (createdAt, updatedAt time.Time) {
+	now := time.Now().UTC()
+	createdAt, updatedAt = d.CreatedAt, d.UpdatedAt
+	if createdAt.IsZero() {
+		createdAt = now
+	}
+	if updatedAt.IsZero() {
+		updatedAt = now
+	}
+	return createdAt, updatedAt
+}
+
+// profileUpsertSuffix is the ON CONFLICT clause shared by Upsert and UpsertBatch.
+// created_at keeps the earlier of the stored and incoming values: a source timestamp
+// replaces a later replica-stamped one, while the now() fallback for inputs without a
+// CreatedAt never moves an existing row forward.
+const profileUpsertSuffix = `
+			ON CONFLICT (account_id) DO UPDATE SET
+				username  = EXCLUDED.username,
+				official  = EXCLUDED.official,
+				pseudonym = EXCLUDED.pseudonym,
+				created_at = LEAST(` + ProfileTable + `.created_at, EXCLUDED.created_at),
+				updated_at = EXCLUDED.updated_at
+			RETURNING ` + ProfileColumns
+
 func (q ProfilesQ) Upsert(ctx context.Context, data ProfileUpsertInput) (Profile, error) {
+	createdAt, updatedAt := data.timestamps()
+
 	query, args, err := q.inserter.
 		SetMap(map[string]interface{}{
 			"account_id": data.AccountID,
 			"username":   data.Username,
 			"official":   data.Official,
 			"pseudonym":  data.Pseudonym,
+			"created_at": createdAt,
+			"updated_at": updatedAt,
 		}).
-		Suffix(`
-			ON CONFLICT (account_id) DO UPDATE SET
-				username  = EXCLUDED.username,
-				official  = EXCLUDED.official,
-				pseudonym = EXCLUDED.pseudonym,
-				updated_at = (now() at time zone 'utc')
-			RETURNING ` + ProfileColumns,
-		).
+		Suffix(profileUpsertSuffix).
 		ToSql()
 
 	if err != nil {
-		return Profile{}, fmt.Errorf("building upsert query for %s: %w", ProfileTable, err)
+		return Profile{}, &QueryError{Table: ProfileTable, Op: "building upsert query", Err: err}
 	}
 
 	var result Profile
@@ -125,17 +182,134 @@ func (q ProfilesQ) Upsert(ctx context.Context, data ProfileUpsertInput) (Profile
 	return result, nil
 }
 
+func (q ProfilesQ) UpsertBatch(ctx context.Context, data []ProfileUpsertInput) ([]Profile, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	// ON CONFLICT can't touch the same row twice in one statement, so collapse
+	// duplicates keeping the last entry for each account before splitting into
+	// chunks; that way no account spans two chunks and the last write still wins.
+	index := make(map[uuid.UUID]int, len(data))
+	rows := make([]ProfileUpsertInput, 0, len(data))
+	for _, d := range data {
+		if i, ok := index[d.AccountID]; ok {
+			rows[i] = d
+			continue
+		}
+		index[d.AccountID] = len(rows)
+		rows = append(rows, d)
+	}
+
+	if len(rows) <= insertBatchSize {
+		return q.upsertBatch(ctx, rows)
+	}
+
+	upsertChunks := func(ctx context.Context, q ProfilesQ) ([]Profile, error) {
+		out := make([]Profile, 0, len(rows))
+		for start := 0; start < len(rows); start += insertBatchSize {
+			end := min(start+insertBatchSize, len(rows))
+
+			batch, err := q.upsertBatch(ctx, rows[start:end])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, batch...)
+		}
+		return out, nil
+	}
+
+	// Larger batches take several statements; unless the caller already holds a
+	// transaction, run them in one so a failing chunk doesn't leave earlier ones applied.
+	db, ok := q.db.(*sql.DB)
+	if !ok {
+		return upsertChunks(ctx, q)
+	}
+
+	var out []Profile
+	err := pgx.Transaction(db, ctx, func(ctx context.Context) error {
+		tq := q
+		tq.db = pgx.Exec(db, ctx)
+
+		var err error
+		out, err = upsertChunks(ctx, tq)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (q ProfilesQ) upsertBatch(ctx context.Context, rows []ProfileUpsertInput) ([]Profile, error) {
+	ins := q.inserter.Columns("account_id", "username", "official", "pseudonym", "created_at", "updated_at")
+	for _, d := range rows {
+		createdAt, updatedAt := d.timestamps()
+		ins = ins.Values(d.AccountID, d.Username, d.Official, d.Pseudonym, createdAt, updatedAt)
+	}
+
+	query, args, err := ins.
+		Suffix(profileUpsertSuffix).
+		ToSql()
+	if err != nil {
+		return nil, &QueryError{Table: ProfileTable, Op: "building upsert batch query", Err: err}
+	}
+
+	res, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &QueryError{Table: ProfileTable, Op: "executing upsert batch query", Err: err}
+	}
+	defer res.Close()
+
+	out := make([]Profile, 0, len(rows))
+	for res.Next() {
+		var p Profile
+		if err = p.scan(res); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	if err = res.Err(); err != nil {
+		return nil, &QueryError{Table: ProfileTable, Op: "iterating rows", Err: err}
+	}
+
+	return out, nil
+}
+
+func (q ProfilesQ) Exists(ctx context.Context) (bool, error) {
+	existsQ := q.selector.
+		Columns("1").
+		RemoveLimit().
+		RemoveOffset().
+		Prefix("SELECT EXISTS (").
+		Suffix(") AS exists").
+		Limit(1)
+
+	query, args, err := existsQ.ToSql()
+	if err != nil {
+		return false, &QueryError{Table: ProfileTable, Op: "building exists query", Err: err}
+	}
+
+	var ok bool
+	if err = q.db.QueryRowContext(ctx, query, args...).Scan(&ok); err != nil {
+		return false, &QueryError{Table: ProfileTable, Op: "scanning exists", Err: err}
+	}
+
+	return ok, nil
+}
+
 func (q ProfilesQ) Get(ctx context.Context) (Profile, error) {
 	query, args, err := q.selector.Limit(1).ToSql()
 	if err != nil {
-		return Profile{}, fmt.Errorf("building select query for %s: %w", ProfileTable, err)
+		return Profile{}, &QueryError{Table: ProfileTable, Op: "building select query", Err: err}
 	}
 
 	var p Profile
 	if err = p.scan(q.db.QueryRowContext(ctx, query, args...)); err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return Profile{}, nil
+			return Profile{}, &QueryError{Table: ProfileTable, Op: "getting row", Err: ErrNotFound}
 		default:
 			return Profile{}, err
 		}
@@ -143,20 +317,30 @@ func (q ProfilesQ) Get(ctx context.Context) (Profile, error) {
 	return p, nil
 }
 
+func (q ProfilesQ) GetByUsername(ctx context.Context, username string) (Profile, error) {
+	return q.FilterByUsername(username).Get(ctx)
+}
+
 func (q ProfilesQ) Select(ctx context.Context) ([]Profile, error) {
 	query, args, err := q.selector.ToSql()
 	if err != nil {
-		return nil, fmt.Errorf("building select query for %s: %w", ProfileTable, err)
+		return nil, &QueryError{Table: ProfileTable, Op: "building select query", Err: err}
 	}
 
 	rows, err := q.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("executing select query for %s: %w", ProfileTable, err)
+		return nil, &QueryError{Table: ProfileTable, Op: "executing select query", Err: err}
 	}
 	defer rows.Close()
 
 	var out []Profile
-	for rows.Next() {
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
 		var p Profile
 		if err = p.scan(rows); err != nil {
 			return nil, err
@@ -164,35 +348,80 @@ func (q ProfilesQ) Select(ctx context.Context) ([]Profile, error) {
 		out = append(out, p)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, &QueryError{Table: ProfileTable, Op: "iterating rows", Err: err}
 	}
 
 	return out, nil
 }
 
+func (q ProfilesQ) Each(ctx context.Context, fn func(Profile) error) error {
+	query, args, err := q.selector.ToSql()
+	if err != nil {
+		return &QueryError{Table: ProfileTable, Op: "building select query", Err: err}
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &QueryError{Table: ProfileTable, Op: "executing select query", Err: err}
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		if i%selectCtxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		var p Profile
+		if err = p.scan(rows); err != nil {
+			return err
+		}
+		if err = fn(p); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return &QueryError{Table: ProfileTable, Op: "iterating rows", Err: err}
+	}
+
+	return nil
+}
+
 func (q ProfilesQ) Delete(ctx context.Context) error {
+	_, err := q.DeleteReturning(ctx)
+	return err
+}
+
+func (q ProfilesQ) DeleteReturning(ctx context.Context) (int64, error) {
 	query, args, err := q.deleter.ToSql()
 	if err != nil {
-		return fmt.Errorf("building delete query for %s: %w", ProfileTable, err)
+		return 0, &QueryError{Table: ProfileTable, Op: "building delete query", Err: err}
+	}
+
+	res, err := q.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, &QueryError{Table: ProfileTable, Op: "executing delete query", Err: err}
 	}
 
-	_, err = q.db.ExecContext(ctx, query, args...)
+	aff, err := res.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("executing delete query for %s: %w", ProfileTable, err)
+		return 0, &QueryError{Table: ProfileTable, Op: "rows affected", Err: err}
 	}
 
-	return nil
+	return aff, nil
 }
 
 func (q ProfilesQ) Count(ctx context.Context) (uint, error) {
 	query, args, err := q.counter.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building count query for %s: %w", ProfileTable, err)
+		return 0, &QueryError{Table: ProfileTable, Op: "building count query", Err: err}
 	}
 
 	var count uint
 	if err = q.db.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
-		return 0, fmt.Errorf("scanning count for %s: %w", ProfileTable, err)
+		return 0, &QueryError{Table: ProfileTable, Op: "scanning count", Err: err}
 	}
 
 	return count, nil
@@ -203,7 +432,7 @@ func (q ProfilesQ) UpdateOne(ctx context.Context) (Profile, error) {
 
 	query, args, err := q.updater.Suffix("RETURNING " + ProfileColumns).ToSql()
 	if err != nil {
-		return Profile{}, fmt.Errorf("building update query for %s: %w", ProfileTable, err)
+		return Profile{}, &QueryError{Table: ProfileTable, Op: "building update query", Err: err}
 	}
 
 	var updated Profile
@@ -218,17 +447,17 @@ func (q ProfilesQ) UpdateMany(ctx context.Context) (int64, error) {
 
 	query, args, err := q.updater.ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("building update query for %s: %w", ProfileTable, err)
+		return 0, &QueryError{Table: ProfileTable, Op: "building update query", Err: err}
 	}
 
 	res, err := q.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return 0, fmt.Errorf("executing update query for %s: %w", ProfileTable, err)
+		return 0, &QueryError{Table: ProfileTable, Op: "executing update query", Err: err}
 	}
 
 	aff, err := res.RowsAffected()
 	if err != nil {
-		return 0, fmt.Errorf("rows affected for %s: %w", ProfileTable, err)
+		return 0, &QueryError{Table: ProfileTable, Op: "rows affected", Err: err}
 	}
 
 	return aff, nil
@@ -242,6 +471,22 @@ func (q ProfilesQ) FilterByAccountID(accountID uuid.UUID) ProfilesQ {
 	return q
 }
 
+func (q ProfilesQ) FilterByAccountIDs(ids ...uuid.UUID) ProfilesQ {
+	if len(ids) == 0 {
+		q.selector = q.selector.Where(sq.Expr("1=0"))
+		q.counter = q.counter.Where(sq.Expr("1=0"))
+		q.updater = q.updater.Where(sq.Expr("1=0"))
+		q.deleter = q.deleter.Where(sq.Expr("1=0"))
+		return q
+	}
+
+	q.selector = q.selector.Where(sq.Eq{"p.account_id": ids})
+	q.counter = q.counter.Where(sq.Eq{"p.account_id": ids})
+	q.updater = q.updater.Where(sq.Eq{"p.account_id": ids})
+	q.deleter = q.deleter.Where(sq.Eq{"p.account_id": ids})
+	return q
+}
+
 func (q ProfilesQ) FilterByUsername(username string) ProfilesQ {
 	q.selector = q.selector.Where(sq.Eq{"p.username": username})
 	q.counter = q.counter.Where(sq.Eq{"p.username": username})
@@ -274,6 +519,30 @@ func (q ProfilesQ) FilterLikePseudonym(pseudonym string) ProfilesQ {
 	return q
 }
 
+func (q ProfilesQ) FilterPseudonymNull(isNull bool) ProfilesQ {
+	var expr sq.Sqlizer = sq.NotEq{"p.pseudonym": nil}
+	if isNull {
+		expr = sq.Eq{"p.pseudonym": nil}
+	}
+
+	q.selector = q.selector.Where(expr)
+	q.counter = q.counter.Where(expr)
+	q.updater = q.updater.Where(expr)
+	q.deleter = q.deleter.Where(expr)
+	return q
+}
+
+func (q ProfilesQ) SearchText(term string) ProfilesQ {
+	expr := sq.Or{
+		sq.ILike{"p.username": "%" + term + "%"},
+		sq.ILike{"p.pseudonym": "%" + term + "%"},
+	}
+
+	q.selector = q.selector.Where(expr)
+	q.counter = q.counter.Where(expr)
+	return q
+}
+
 func (q ProfilesQ) UpdateUsername(username string) ProfilesQ {
 	q.updater = q.updater.Set("username", username)
 	return q
@@ -306,3 +575,26 @@ func (q ProfilesQ) CursorCreatedAt(limit uint, asc bool, createdAt time.Time, ac
 
 	return q
 }
+
+func (q ProfilesQ) CursorUsername(limit uint, asc bool, lastUsername string, lastAccountID uuid.UUID) ProfilesQ {
+	if asc {
+		q.selector = q.selector.OrderBy("p.username ASC", "p.account_id ASC")
+	} else {
+		q.selector = q.selector.OrderBy("p.username DESC", "p.account_id DESC")
+	}
+
+	q.selector = q.selector.Limit(uint64(limit))
+
+	// empty cursor means the first page
+	if lastUsername == "" && lastAccountID == uuid.Nil {
+		return q
+	}
+
+	if asc {
+		q.selector = q.selector.Where(sq.Expr("(p.username, p.account_id) > (?, ?)", lastUsername, lastAccountID))
+	} else {
+		q.selector = q.selector.Where(sq.Expr("(p.username, p.account_id) < (?, ?)", lastUsername, lastAccountID))
+	}
+
+	return q
+}
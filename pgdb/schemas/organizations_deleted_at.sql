@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE organizations ADD COLUMN deleted_at TIMESTAMPTZ;
+
+-- +migrate Down
+ALTER TABLE organizations DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,6 @@
+-- +migrate Up notransaction
+ALTER TYPE organization_invite_status ADD VALUE IF NOT EXISTS 'expired';
+
+-- +migrate Down
+-- Postgres can't drop an enum value, so only move expired invites back to 'sent'.
+UPDATE organization_invites SET status = 'sent' WHERE status = 'expired';
@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE organizations ADD COLUMN status_changed_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- Existing rows have no record of their last status change; updated_at is the
+-- closest bound we have, and is better than the time this migration ran.
+UPDATE organizations SET status_changed_at = updated_at;
+
+-- +migrate Down
+ALTER TABLE organizations DROP COLUMN IF EXISTS status_changed_at;
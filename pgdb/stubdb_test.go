@@ -0,0 +1,69 @@
+package pgdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+)
+
+// stubConn is a database/sql connection that records the last query it was
+// given and answers it with a fixed result set.
+type stubConn struct {
+	columns []string
+	rows    [][]driver.Value
+
+	query string
+	args  []driver.NamedValue
+}
+
+func newStubDB(t *testing.T, c *stubConn) *sql.DB {
+	t.Helper()
+	db := sql.OpenDB(stubConnector{c})
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+type stubConnector struct{ c *stubConn }
+
+func (s stubConnector) Connect(context.Context) (driver.Conn, error) { return s.c, nil }
+func (s stubConnector) Driver() driver.Driver                        { return stubDriver{s.c} }
+
+type stubDriver struct{ c *stubConn }
+
+func (d stubDriver) Open(string) (driver.Conn, error) { return d.c, nil }
+
+func (c *stubConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("stub: prepare not supported")
+}
+
+func (c *stubConn) Close() error { return nil }
+
+func (c *stubConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("stub: transactions not supported")
+}
+
+func (c *stubConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.query = query
+	c.args = args
+	return &stubRows{columns: c.columns, rows: c.rows}, nil
+}
+
+type stubRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *stubRows) Columns() []string { return r.columns }
+func (r *stubRows) Close() error      { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}